@@ -2,9 +2,13 @@ module imap-tool
 
 go 1.23.2
 
-require github.com/emersion/go-imap v1.2.1
+require (
+	github.com/emersion/go-imap v1.2.1
+	golang.org/x/term v0.25.0
+	golang.org/x/text v0.3.7
+)
 
 require (
 	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/sys v0.26.0 // indirect
 )
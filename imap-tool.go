@@ -4,14 +4,101 @@
 //
 //  Flags
 //    -email  user@example.com   ·required
-//    -password  ***             ·required
-//    -imap host:port            (auto‑guess if omitted)
-//    -field from|to|subject     (stats & -match)   default: from
+//    -password  ***             ·required (- = stdin, or $IMAP_PASSWORD)
+//    -password-command 'pass show imap/work'  (run at every login instead)
+//    -oauth-token TOKEN         (XOAUTH2 login, e.g. Gmail / Office365)
+//    -accounts list.csv         (email,password,imap rows; run each in turn)
+//    -imap host:port            (provider profile / auto‑guess if omitted)
+//    -field from|to|subject|in-reply-to|message-id  (stats & -match)   default: from
+//    -field folder              (stats: one bucket per folder)
+//    -field size                (stats: size histogram, RFC822.SIZE only)
+//    -field auth-result         (pass / fail / none from DKIM and SPF)
+//    -field from,subject        (-match either; stats key "from | subject")
+//    -by-folder                 (stats: a separate FIELD table per folder)
+//    -match-header References   (any header as FIELD)
+//    -fuzzy [-fuzzy-distance 2] (-match within N edits: biqcorp ~ bigcorp)
+//    -regex                     (-match is a regexp: '^(news|promo)@')
 //    -match "text"              (delete interactively)
+//    -match-preview-table       (page matched folders; delete per folder/page/all)
+//    -subject-any "sale,% off"  (match any subject phrase)
+//    -exclude "invoice" [-exclude-field subject]  (carve out of -match)
+//    -exclude-self              (never count/match own mail or Sent)
+//    -report                    (match counts only, no delete prompt)
+//    -unsubscribe               (POST one-click unsubscribe for matched senders)
+//    -print-uids                (folder<TAB>uid list on stdout)
+//    -uids-file del.txt         (delete a folder<TAB>uid list & exit)
+//    -match-received relay.host (match the Received: chain, /re/ ok)
+//    -attachment-type application/pdf  (match by MIME part type)
+//    -match-auth fail           (DKIM/SPF in Authentication-Results: pass|fail|none)
+//    -sample                    (preview -match on INBOX before full scan)
+//    -log-file audit.log        (JSON-lines record of every deletion)
+//    -keep-flagged              (never delete starred mail)
+//    -move Archive              (move instead of delete; folder is created)
+//    -dry-run                   (report what would be deleted, no prompts)
+//    -quiet                     (no progress/status lines; piped: a plain line every 30s)
+//    -yes                       (delete the -match result without asking)
+//    -mark read|unread          (set / clear \Seen instead of deleting)
+//    -export-plan plan.json     (dry run that saves the delete set for review)
+//    -execute-plan plan.json    (delete exactly that set later, after checks)
+//    -safe                      (back up every message before delete)
+//    -export ./mail             (save the delete set as .eml files first)
+//    -strip-attachments -min-size 5MB -export ./att  (cut big attachments out)
+//    -confirm-summary           (top senders/folders before each delete prompt)
+//    -keep-latest 3             (bucket / per-sender match delete keeps the 3 newest)
+//    -keep-recent 30d           (never delete mail younger than 30 days)
+//    -delete-batch 500          (STORE+EXPUNGE per batch)
+//    -checkpoint wipe.ckpt      (resume an interrupted delete)
 //    -size                      (add MB column to stats)
-//    -backup   mailbox.tgz      (make backup & exit)
+//    -sort size                 (stats: biggest total bytes first; implies -size)
+//    -between 2023-01-01:2023-06-30  (stats & -match date window)
+//    -older-than 365d           (only mail older than a year; or a date)
+//    -newer-than 12w            (only mail from the last 12 weeks)
+//    -stats-out report.txt      (save all stats pages to a file)
+//    -metrics-file imap.prom    (Prometheus textfile: scanned/deleted/errors)
+//    -template '{{.Key}}\t{{.Cnt}}\t{{.Bytes}}'  (stats rows, no table)
+//    -stream-json               (one JSON line per message while scanning)
+//    -json [-json-uids]         (stats as a JSON array on stdout, no prompts)
+//    -precompute-total          (STATUS pre-pass for a % and ETA progress line)
+//    -concurrency 4             (connections scanning folders in parallel)
+//    -limit 500                 (sample the newest 500 msgs of each folder)
+//    -scan-resume scan.gob      (stats: resume an interrupted scan)
+//    -resume-token imapt1.…     (skip what an interrupted run already scanned)
+//    -include-deleted           (count mail already flagged \Deleted)
+//    -header-fallback           (read headers when ENVELOPE is incomplete)
+//    -fast                      (always scan header fields, skip the ENVELOPE probe)
+//    -scan-batch 1000           (UIDs per FETCH; 0 = auto)
+//    -detect-charset            (fix mislabeled KOI8-R/CP1251/GBK… headers)
+//    -repl                      (interactive search console)
+//    -backup   mailbox.tgz      (make backup & exit; an existing one is topped up)
+//    -backup-parallel N         (back up N folders at once)
+//    -backup-include-deleted    (keep \Deleted mail in the archive)
+//    -backup-skip-larger 50MB   (leave huge messages out; listed in .skipped.tsv)
+//    -index all.jsonl           (per-message index next to -backup)
+//    -grep-archive "text"       (search -index offline, no login)
 //    -restore  mailbox.tgz      (restore & exit)
+//    -backup - | gpg -c > m.gpg (archive to stdout; -restore - reads stdin)
+//    -restore-delay 50ms  -restore-retries 3
+//    -restore-batch 20          (MULTIAPPEND: messages per APPEND)
+//    -restore-uid-map map.csv   (old→new UID via UIDPLUS APPENDUID)
+//    -restore-collision skip|keep-both|replace  (Message-ID already there)
+//    -restore-folder Sent       (repeatable; restore only these)
+//    -folders 'INBOX,Sent,Work/*'  (backup/stats/match only these folders)
+//    -restore-source maildir    (tar of a maildir; dates from file names)
+//    -delimiter .               (force the server's hierarchy delimiter)
+//    -no-guess                  (fail if -imap is empty)
+//    -timeout 2m  -search-timeout 5m
+//    -max-retries 3             (reconnect and resume after a dropped connection)
 //    -allow-plain               (allow PLAINTEXT on :143)
+//    -insecure                  (accept any TLS certificate)
+//    -tls-client-cert c.pem -tls-client-key k.pem  (mutual TLS)
+//    -send-id  [-id-name x]     (send IMAP ID, e.g. 163.com / Yahoo)
+//    -quota                     (QUOTA usage + folder sizes & exit)
+//    -diagnose                  (probe 993/143 without login & exit)
+//    -folder-report out.json    (per-folder msgs/unseen/size/dates & exit; .csv ok)
+//    -clean-drafts 90d          (delete abandoned drafts & exit)
+//    -dedup                     (delete extra copies by Message-Id & exit)
+//    -dedup-move Duplicates     (move them there for review instead)
+//    -dedup-key subject+date    (or body-hash: copies whose Message-Id differs)
 //
 //  Typical runs
 //    go run imap-cleaning-tool.go -email you -password pw -match spam
@@ -21,40 +108,210 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
+	"mime/quotedprintable"
 	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"golang.org/x/term"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
 )
 
 /* ── flags ─────────────────────────────────────────────── */
 
 var (
-	emailF    = flag.String("email", "", "Email")
-	passF     = flag.String("password", "", "Password")
-	imapF     = flag.String("imap", "", "IMAP host:port")
-	fieldF    = flag.String("field", "from", "from | to | subject")
-	matchF    = flag.String("match", "", "Text to match in FIELD")
-	sizeF     = flag.Bool("size", false, "Add MB column in stats")
-	backupF   = flag.String("backup", "", "Create backup & exit")
-	restoreF  = flag.String("restore", "", "Restore backup & exit")
-	allowPlnF = flag.Bool("allow-plain", false, "Allow PLAINTEXT on 143")
-	pageSz    = 20
+	emailF     = flag.String("email", "", "Email")
+	acctsF     = flag.String("accounts", "", "CSV of email,password[,imap]: run for each account in turn")
+	passF      = flag.String("password", "", "Password; - reads it from stdin, unset uses $IMAP_PASSWORD")
+	oauthF     = flag.String("oauth-token", "", "OAuth2 access token: log in with SASL XOAUTH2 instead of a password (\"-\" = stdin, default $IMAP_OAUTH_TOKEN)")
+	passCmdF   = flag.String("password-command", "", "Shell command printing the password; run for every login")
+	imapF      = flag.String("imap", "", "IMAP host:port")
+	fieldF     = flag.String("field", "from", "from | to | subject | in-reply-to | message-id | auth-result | folder | size")
+	byFoldF    = flag.Bool("by-folder", false, "Stats: one table per folder instead of one for the account")
+	matchF     = flag.String("match", "", "Text to match in FIELD")
+	fuzzyF     = flag.Bool("fuzzy", false, "Match FIELD within -fuzzy-distance edits of -match (client-side)")
+	fuzzyDistF = flag.Int("fuzzy-distance", 2, "Edits allowed by -fuzzy")
+	regexF     = flag.Bool("regex", false, "Treat -match as a regular expression, case-insensitive unless it sets its own flags (client-side)")
+	matchHdrF  = flag.String("match-header", "", "Use this raw header (e.g. References) as FIELD")
+	sizeF      = flag.Bool("size", false, "Add MB column in stats")
+	sortF      = flag.String("sort", "count", "Stats order: count | size (total bytes; turns -size on)")
+	backupF    = flag.String("backup", "", "Create backup & exit")
+	restoreF   = flag.String("restore", "", "Restore backup & exit")
+	certF      = flag.String("tls-client-cert", "", "PEM client certificate for mutual TLS")
+	keyF       = flag.String("tls-client-key", "", "PEM private key for -tls-client-cert")
+	insecureF  = flag.Bool("insecure", false, "Skip TLS certificate verification (self-signed servers)")
+	allowPlnF  = flag.Bool("allow-plain", false, "Allow PLAINTEXT on 143")
+	restFoldF  = multi("restore-folder", "Restore only this folder (repeatable)")
+	foldersF   = flag.String("folders", "", "Comma-separated folders or globs (INBOX,Sent,Work/*) to back up or scan")
+	restDelayF = flag.Duration("restore-delay", 0, "Pause between restored messages (e.g. 50ms)")
+	restSrcF   = flag.String("restore-source", "native", "Archive layout for -restore: native | maildir")
+	delimF     = flag.String("delimiter", "", "Hierarchy delimiter to use instead of the one LIST reports (one character)")
+	uidMapF    = flag.String("restore-uid-map", "", "Write entry,old_uid,folder,new_uid CSV from APPENDUID")
+	restBatchF = flag.Int("restore-batch", 1, "Messages per APPEND when the server has MULTIAPPEND")
+	collF      = flag.String("restore-collision", "", "Message-ID already in the folder: skip | keep-both | replace")
+	restRetryF = flag.Int("restore-retries", 3, "Retries per failed Append during restore")
+	dedupF     = flag.Bool("dedup", false, "Find duplicate messages (same Message-Id, see -dedup-key), offer to delete all but one copy & exit")
+	dedupKeyF  = flag.String("dedup-key", "message-id", "What makes -dedup copies the same: message-id | subject+date | body-hash")
+	dedupMvF   = flag.String("dedup-move", "", "With -dedup: move the extra copies to this folder (created if missing) instead of deleting them")
+	draftsF    = flag.String("clean-drafts", "", "Delete drafts older than AGE (e.g. 90d) & exit")
+	foldRepF   = flag.String("folder-report", "", "Write per-folder counts/size/dates to this .json or .csv & exit")
+	diagF      = flag.Bool("diagnose", false, "Probe 993/143 (TLS, STARTTLS, caps) without logging in & exit")
+	quotaF     = flag.Bool("quota", false, "Show quota usage and a per-folder msgs/size table & exit")
+	tmplF      = flag.String("template", "", "Print each stats row with this text/template (e.g. '{{.Key}}\\t{{.Cnt}}') & exit")
+	statsOutF  = flag.String("stats-out", "", "Also write the full stats table to this file")
+	metricsF   = flag.String("metrics-file", "", "Write Prometheus metrics of the run to this file (node_exporter textfile)")
+	moveF      = flag.String("move", "", "Move matched/bucket messages to this folder instead of deleting")
+	markF      = flag.String("mark", "", "read | unread: set or clear \\Seen on the selection instead of deleting it")
+	quietF     = flag.Bool("quiet", false, "No progress or status lines, only summaries, tables and errors")
+	yesF       = flag.Bool("yes", false, "Answer the delete prompt with yes (needs -match or another explicit selection)")
+	dryRunF    = flag.Bool("dry-run", false, "Show what would be deleted, never ask and never change the server")
+	stripF     = flag.Bool("strip-attachments", false, "Match mode: save attachments over -min-size to -export DIR and replace them by a stub in the message")
+	stripMinF  = flag.String("min-size", "5MB", "Smallest attachment -strip-attachments takes out")
+	exportF    = flag.String("export", "", "Save the selected messages as DIR/<folder>/<uid>.eml before they are deleted, moved or marked")
+	safeF      = flag.Bool("safe", false, "Archive messages to a timestamped .tgz right before deleting them")
+	confSumF   = flag.Bool("confirm-summary", false, "Show top senders/folders of a delete set before asking")
+	keepLatF   = flag.Int("keep-latest", 0, "When deleting a bucket keep its K newest messages")
+	keepRecF   = flag.String("keep-recent", "", "Never delete mail newer than this age (30d, 2w, 12h or a date)")
+	keepFlagF  = flag.Bool("keep-flagged", false, "Never delete \\Flagged (starred) mail")
+	delBatchF  = flag.Int("delete-batch", 500, "Messages per STORE+EXPUNGE batch")
+	ckptF      = flag.String("checkpoint", "", "Record deleted UIDs here; resume skips them")
+	logFileF   = flag.String("log-file", "", "Append deleted messages to this JSON-lines audit log")
+	betweenF   = flag.String("between", "", "Only mail dated START:END (YYYY-MM-DD:YYYY-MM-DD)")
+	olderF     = flag.String("older-than", "", "Only mail older than this age (90d, 12w, 12h) or date")
+	newerF     = flag.String("newer-than", "", "Only mail newer than this age (90d, 12w, 12h) or date")
+	exclSelfF  = flag.Bool("exclude-self", false, "Leave out mail from -email and the Sent folder")
+	excludeF   = flag.String("exclude", "", "Keep matches whose EXCLUDE-FIELD contains this text")
+	exclFldF   = flag.String("exclude-field", "", "Field for -exclude (default: -field)")
+	attTypeF   = flag.String("attachment-type", "", "Match messages with a MIME part of this type (e.g. application/pdf)")
+	matchRcvF  = flag.String("match-received", "", "Match Received: headers (substring, or /regex/)")
+	matchAuthF = flag.String("match-auth", "", "Match the DKIM/SPF verdict of Authentication-Results: pass | fail | none")
+	planOutF   = flag.String("export-plan", "", "Dry run that writes every intended delete (folder/uid/from/subject/size) to this JSON file")
+	planInF    = flag.String("execute-plan", "", "Carry out an -export-plan file after re-checking UIDVALIDITY and UIDs & exit")
+	uidsFileF  = flag.String("uids-file", "", "Delete the folder<TAB>uid lines of this file (see -print-uids) & exit")
+	matchTblF  = flag.Bool("match-preview-table", false, "Match mode: page through matched folders in the stats table and delete per folder, page or all")
+	printUIDsF = flag.Bool("print-uids", false, "Match mode: print folder<TAB>uid of every match on stdout")
+	jsonF      = flag.Bool("json", false, "Stats: print the table as a JSON array on stdout and never prompt")
+	jsonUIDsF  = flag.Bool("json-uids", false, "With -json: add each bucket's UIDs per folder")
+	streamF    = flag.Bool("stream-json", false, "Print one JSON line per scanned (or matched) message on stdout instead of bucketing")
+	unsubF     = flag.Bool("unsubscribe", false, "Match mode: offer RFC 8058 one-click unsubscribe for matched senders")
+	reportF    = flag.Bool("report", false, "Match mode: print breakdown only, never delete")
+	subjAnyF   = flag.String("subject-any", "", "Comma-separated phrases; match if SUBJECT contains any")
+	inclDelF   = flag.Bool("include-deleted", false, "Count messages already flagged \\Deleted in stats/match")
+	resTokF    = flag.String("resume-token", "", "Token printed by an interrupted scan: skip the folders/UIDs it covered")
+	scanResF   = flag.String("scan-resume", "", "Stats: cache finished folders here; a rerun reuses unchanged ones")
+	precompF   = flag.Bool("precompute-total", false, "STATUS all folders first to show scan progress in %")
+	replF      = flag.Bool("repl", false, "Interactive search & delete console")
+	sampleF    = flag.Bool("sample", false, "Try -match on INBOX first, then ask")
+	detectF    = flag.Bool("detect-charset", false, "Re-decode mislabeled or raw 8-bit headers with a guessed charset")
+	fastF      = flag.Bool("fast", false, "Always fetch header fields instead of ENVELOPE when scanning (default: time both on the first folder)")
+	hdrFbF     = flag.Bool("header-fallback", false, "Parse FROM/TO/SUBJECT headers when ENVELOPE lacks them")
+	indexF     = flag.String("index", "", "JSONL index written by -backup, read by -grep-archive")
+	grepArchF  = flag.String("grep-archive", "", "Search a backup's -index offline & exit")
+	bkInclDelF = flag.Bool("backup-include-deleted", false, "Also back up messages flagged \\Deleted")
+	bkMaxF     = flag.String("backup-skip-larger", "", "Leave messages over this size (50MB) out of -backup")
+	limitF     = flag.Int("limit", 0, "Scan only the newest N messages (highest UIDs) of each folder, as a quick sample")
+	concF      = flag.Int("concurrency", 4, "Connections that scan folders at the same time")
+	scanBatchF = flag.Int("scan-batch", 0, "UIDs per FETCH for scans and backups (0 = auto, 5000)")
+	backupParF = flag.Int("backup-parallel", 1, "Connections used by -backup")
+	timeoutF   = flag.Duration("timeout", 2*time.Minute, "Deadline per IMAP command (bulk FETCH excluded)")
+	maxRetryF  = flag.Int("max-retries", 3, "Reconnects per folder after a network error during scan or backup")
+	searchToF  = flag.Duration("search-timeout", 5*time.Minute, "Deadline per SEARCH")
+	noGuessF   = flag.Bool("no-guess", false, "Fail instead of probing for a server when -imap is empty")
+	sendIDF    = flag.Bool("send-id", false, "Send IMAP ID after login (auto for providers that need it)")
+	idNameF    = flag.String("id-name", "imap-tool", "Client name sent with -send-id")
+	pageSz     = 20
+
+	version = "dev" // set by scripts/crosscompile.go via -ldflags
+
+	uidOut io.Writer = os.Stdout // -print-uids / -stream-json destination
+
+	subjTerms []string // parsed -subject-any
+
+	folderPats []string // parsed -folders
+
+	bkMaxSize int64 // parsed -backup-skip-larger, 0 = no limit
+	stripMin  int64 // parsed -min-size
+
+	resumeTok *resumeToken // parsed -resume-token
+
+	winSince, winBefore time.Time // SEARCH date window (-between, -older-than, -newer-than)
+
+	recentCut time.Time // parsed -keep-recent
+
+	clientCerts []tls.Certificate // loaded -tls-client-cert/-key
+
+	rowTmpl *template.Template // parsed -template
 )
 
+// multiFlag collects a repeatable string flag.
+type multiFlag []string
+
+func (m *multiFlag) String() string { return strings.Join(*m, ",") }
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+func (m multiFlag) has(v string) bool {
+	for _, x := range m {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// multi registers a repeatable flag, like flag.String does for one value.
+func multi(name, usage string) *multiFlag {
+	m := new(multiFlag)
+	flag.Var(m, name, usage)
+	return m
+}
+
 /* ── helper funcs ───────────────────────────────────────── */
 
 func trim(s string) string {
@@ -63,25 +320,370 @@ func trim(s string) string {
 	}
 	return s[:37] + "…"
 }
+
+/* ── progress lines ───────────────────────────────────── */
+
+var (
+	progOnce sync.Once
+	progTTY  bool
+	progMu   sync.Mutex
+	progLen  int       // runes of the line on screen
+	progLast time.Time // last plain line when stdout is no terminal
+)
+
+// progressTTY reports whether stdout (as swapped by -json and friends)
+// is a terminal, where a line can be redrawn in place.
+func progressTTY() bool {
+	progOnce.Do(func() { progTTY = term.IsTerminal(int(os.Stdout.Fd())) })
+	return progTTY
+}
+
+// progress shows a live status line: redrawn in place on a terminal, as
+// a plain line at most every 30s in a log file, not at all under -quiet.
+func progress(format string, a ...interface{}) {
+	if *quietF {
+		return
+	}
+	line := fmt.Sprintf(format, a...)
+	progMu.Lock()
+	defer progMu.Unlock()
+	if !progressTTY() {
+		if time.Since(progLast) >= 30*time.Second {
+			progLast = time.Now()
+			fmt.Println(line)
+		}
+		return
+	}
+	n := utf8.RuneCountInString(line)
+	fmt.Print("\r" + line + strings.Repeat(" ", max(progLen-n, 0)))
+	progLen = n
+}
+
+// progressDone wipes the live line before normal output continues.
+func progressDone() {
+	progMu.Lock()
+	defer progMu.Unlock()
+	if progLen > 0 && progressTTY() {
+		fmt.Print("\r" + strings.Repeat(" ", progLen) + "\r")
+	}
+	progLen = 0
+	progLast = time.Time{}
+}
+
+// note prints a status line that -quiet leaves out, on a line of its
+// own: a live progress line is wiped first and redrawn by the next update.
+func note(format string, a ...interface{}) {
+	if *quietF {
+		return
+	}
+	progMu.Lock()
+	defer progMu.Unlock()
+	if progLen > 0 && progressTTY() {
+		fmt.Print("\r" + strings.Repeat(" ", progLen) + "\r")
+		progLen = 0
+	}
+	fmt.Printf(format+"\n", a...)
+}
+
+// rate formats elapsed time and msgs/s since start and, when total is
+// known, the time left at that pace.
+func rate(start time.Time, done, total int64) string {
+	el := time.Since(start)
+	out := "  " + el.Round(time.Second).String()
+	if el < time.Second || done == 0 {
+		return out
+	}
+	r := float64(done) / el.Seconds()
+	out += fmt.Sprintf("  %.0f/s", r)
+	if total > done {
+		out += "  ETA " + (time.Duration(float64(total-done)/r) * time.Second).Round(time.Second).String()
+	}
+	return out
+}
+
+// classify returns m's FIELD value: the bucket key in stats mode and
+// the text -match is compared against. For a list like "from,subject"
+// it is the values joined by " | ", one composite stats key.
 func classify(m *imap.Message, fld string) string {
+	if strings.Contains(fld, ",") {
+		return strings.Join(classifyEach(m, fld), " | ")
+	}
+	return fixCharset(classifyRaw(m, fld))
+}
+
+// classifyEach returns m's value for every field of a -field list.
+func classifyEach(m *imap.Message, flds string) []string {
+	var out []string
+	for _, f := range strings.Split(flds, ",") {
+		out = append(out, fixCharset(classifyRaw(m, f)))
+	}
+	return out
+}
+
+// hasField reports whether the -field list names fld.
+func hasField(fld string) bool {
+	for _, f := range strings.Split(*fieldF, ",") {
+		if f == fld {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyRaw(m *imap.Message, fld string) string {
 	addr := func(a []*imap.Address) string {
 		if len(a) == 0 {
 			return "(none)"
 		}
 		return a[0].MailboxName + "@" + a[0].HostName
 	}
+	env := m.Envelope
+	if env == nil {
+		env = &imap.Envelope{}
+	}
+	if *matchHdrF != "" && strings.EqualFold(fld, *matchHdrF) {
+		if h := msgHeader(m, customSection()); h != nil {
+			return h.Get(*matchHdrF)
+		}
+		return ""
+	}
 	switch fld {
+	case "size":
+		return sizeClasses[sizeClass(m.Size)].Label
+	case "auth-result":
+		return authResult(m)
+	case "message-id":
+		if env.MessageId == "" {
+			if h := msgHeader(m, hdrSection); h != nil {
+				return h.Get("Message-Id")
+			}
+		}
+		return env.MessageId
+	case "in-reply-to":
+		if env.InReplyTo == "" {
+			if h := msgHeader(m, hdrSection); h != nil {
+				return h.Get("In-Reply-To")
+			}
+		}
+		return env.InReplyTo
 	case "to":
-		return addr(m.Envelope.To)
+		if len(env.To) == 0 {
+			if v := hdrAddr(m, "To"); v != "" {
+				return v
+			}
+		}
+		return addr(env.To)
 	case "subject":
-		sub := m.Envelope.Subject
+		sub := subjectOf(m)
 		if len(sub) > 60 {
 			sub = sub[:57] + "…"
 		}
 		return sub
 	default:
-		return addr(m.Envelope.From)
+		if len(env.From) == 0 {
+			if v := hdrAddr(m, "From"); v != "" {
+				return v
+			}
+		}
+		return addr(env.From)
+	}
+}
+
+// sizeClasses are the -field size histogram buckets, smallest first.
+var sizeClasses = []struct {
+	Max   uint32 // exclusive upper bound; 0 = unbounded
+	Label string
+}{
+	{10 << 10, "< 10 KB"},
+	{100 << 10, "10–100 KB"},
+	{1 << 20, "100 KB–1 MB"},
+	{10 << 20, "1–10 MB"},
+	{0, "≥ 10 MB"},
+}
+
+func sizeClass(sz uint32) int {
+	for i, c := range sizeClasses {
+		if c.Max == 0 || sz < c.Max {
+			return i
+		}
+	}
+	return len(sizeClasses) - 1
+}
+
+func subjectOf(m *imap.Message) string {
+	if m.Envelope != nil && m.Envelope.Subject != "" {
+		return m.Envelope.Subject
+	}
+	return hdrSubject(m)
+}
+
+// dateOf returns the Date header from ENVELOPE or the fetched header fields.
+func dateOf(m *imap.Message) time.Time {
+	if m.Envelope != nil && !m.Envelope.Date.IsZero() {
+		return m.Envelope.Date
+	}
+	if h := msgHeader(m, hdrSection); h != nil {
+		if t, err := mail.ParseDate(h.Get("Date")); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+/* ── header fallback (-header-fallback) ─────────────────── */
+
+var hdrSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"FROM", "TO", "SUBJECT", "DATE", "IN-REPLY-TO", "MESSAGE-ID"},
+	},
+	Peek: true,
+}
+
+// customSection is the -match-header field, fetched alongside ENVELOPE.
+func customSection() *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{strings.ToUpper(*matchHdrF)},
+		},
+		Peek: true,
+	}
+}
+
+// msgHeader parses the fetched header section sec, or returns nil when absent.
+func msgHeader(m *imap.Message, sec *imap.BodySectionName) mail.Header {
+	lit := m.GetBody(sec)
+	if lit == nil {
+		return nil
+	}
+	data, _ := io.ReadAll(lit)
+	want := *sec
+	want.Peek = false
+	for s := range m.Body { // keep the literal readable for later callers
+		if want.Equal(s) {
+			m.Body[s] = bytes.NewReader(data)
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(append(data, "\r\n\r\n"...)))
+	if err != nil {
+		return nil
+	}
+	return msg.Header
+}
+
+func hdrAddr(m *imap.Message, key string) string {
+	h := msgHeader(m, hdrSection)
+	if h == nil {
+		return ""
+	}
+	if a, err := mail.ParseAddress(h.Get(key)); err == nil {
+		return strings.ToLower(a.Address)
+	}
+	return ""
+}
+
+func hdrSubject(m *imap.Message) string {
+	h := msgHeader(m, hdrSection)
+	if h == nil {
+		return ""
+	}
+	sub := h.Get("Subject")
+	if dec, err := (&mime.WordDecoder{CharsetReader: imap.CharsetReader}).DecodeHeader(sub); err == nil {
+		sub = dec
+	}
+	return sub
+}
+
+/* ── charset detection (-detect-charset) ──────────────── */
+
+// charsetGuesses are tried, besides the declared charset, for 8-bit
+// header text: the legacy encodings mislabeled mail most often uses.
+var charsetGuesses = []string{"windows-1251", "koi8-r", "iso-8859-5",
+	"gbk", "big5", "shift_jis", "euc-jp", "euc-kr", "windows-1252"}
+
+// textScore rates how much s looks like real text: lowercase Cyrillic
+// beats the upper-case soup KOI8-R/CP1251 mix-ups produce, CJK scores
+// per character, box drawing, half-width kana and replacement characters
+// count against.
+func textScore(s string) float64 {
+	var sc float64
+	for _, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			sc -= 10
+		case r >= 0xFF61 && r <= 0xFF9F: // half-width katakana: Shift_JIS misreads
+			sc -= 1
+		case r < 0x80:
+			sc++
+		case unicode.Is(unicode.Cyrillic, r) && unicode.IsLower(r):
+			sc += 2
+		case unicode.Is(unicode.Cyrillic, r):
+			sc += 0.5
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			sc += 3
+		case r < 0x100 && unicode.IsLetter(r):
+			sc += 0.5
+		default:
+			sc -= 2
+		}
+	}
+	return sc
+}
+
+// bestDecode decodes raw with whichever candidate charset scores best;
+// declared wins ties. ASCII is returned unchanged.
+func bestDecode(raw []byte, declared string) string {
+	plain := true
+	for _, b := range raw {
+		if b >= 0x80 {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return string(raw)
+	}
+	if utf8.Valid(raw) { // 8-bit text is almost never valid UTF-8 by accident
+		return string(raw)
+	}
+	best, bestSc := strings.ToValidUTF8(string(raw), "\uFFFD"), math.Inf(-1)
+	for i, cs := range append([]string{declared}, charsetGuesses...) {
+		var out string
+		if enc, err := htmlindex.Get(cs); err != nil || strings.EqualFold(cs, "utf-8") {
+			continue
+		} else if b, err := enc.NewDecoder().Bytes(raw); err != nil {
+			continue
+		} else {
+			out = string(b)
+		}
+		sc := textScore(out)
+		if i == 0 {
+			sc *= 1.1
+		}
+		if sc > bestSc {
+			best, bestSc = out, sc
+		}
+	}
+	return best
+}
+
+// detectCharsetReader is imap.CharsetReader under -detect-charset: it
+// re-decodes each RFC 2047 word with the best-scoring charset.
+func detectCharsetReader(charset string, r io.Reader) (io.Reader, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
+	return strings.NewReader(bestDecode(raw, charset)), nil
+}
+
+// fixCharset repairs raw 8-bit header text that is not valid UTF-8.
+func fixCharset(s string) string {
+	if !*detectF || utf8.ValidString(s) {
+		return s
+	}
+	return bestDecode([]byte(s), "utf-8")
 }
 
 /* ── stats bucket ──────────────────────────────────────── */
@@ -101,211 +703,5402 @@ func (b *bucket) add(folder string, uid uint32, sz int64) {
 
 /* ── safe delete ───────────────────────────────────────── */
 
+// action names what wipe will do, for prompts: "Delete" or "Move to X".
+func action() string {
+	if *markF != "" {
+		return "Mark " + *markF
+	}
+	if *moveF != "" {
+		return "Move to " + *moveF
+	}
+	return "Delete"
+}
+
+// confirmDelete asks prompt and reports a "y"; under -dry-run it does not
+// ask, since wipe will only report.
+func confirmDelete(prompt string) bool {
+	if *dryRunF {
+		return true
+	}
+	if *yesF {
+		fmt.Println(prompt + "y (-yes)")
+		return true
+	}
+	fmt.Print(prompt)
+	var ans string
+	fmt.Scanln(&ans)
+	return strings.ToLower(ans) == "y"
+}
+
 func wipe(cli *client.Client, sets map[string][]uint32) {
+	if *dryRunF {
+		// what a real run would keep stays out of the report and the plan
+		if *keepFlagF {
+			var kept int
+			sets, kept = withoutFlagged(cli, sets)
+			if kept > 0 {
+				fmt.Printf("⭐ would keep %d flagged\n", kept)
+			}
+		}
+		var names []string
+		for f := range sets {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		what := "flagged \\Deleted"
+		if *markF != "" {
+			what = "marked " + *markF
+		} else if *moveF != "" {
+			what = "moved to " + *moveF
+		}
+		for _, f := range names {
+			fmt.Printf("  %-35s %6d would be %s\n", f, len(sets[f]), what)
+		}
+		fmt.Printf("DRY RUN — nothing changed (%d msgs)\n", countSets(sets))
+		if *planOutF != "" {
+			if err := exportPlan(cli, sets); err != nil {
+				log.Println("export-plan:", err)
+			} else {
+				fmt.Printf("📝 plan → %s (%d msgs)\n", *planOutF, planMsgs())
+			}
+		}
+		return
+	}
+	audit := openAudit()
+	if audit != nil {
+		defer audit.Close()
+	}
+	if *markF != "" {
+		markSets(cli, sets, audit)
+		return
+	}
+	ck := loadCheckpoint(*ckptF)
+	defer ck.close()
+	// -move, or Gmail's Trash, turns the delete into a UID MOVE (go-imap
+	// falls back to COPY + \Deleted + EXPUNGE without the MOVE extension)
+	target := *moveF
+	if target != "" {
+		cli.Create(target) // an existing folder just refuses
+	} else if target = gmailTrash(cli); target != "" {
+		note("📨 Gmail: moving to %s", target)
+	}
+	var safe *safeArchive
+	if *safeF {
+		var err error
+		if safe, err = newSafeArchive(); err != nil {
+			log.Println("safe backup:", err, "- nothing deleted")
+			return
+		}
+		defer safe.close()
+	}
+
+	var total, done, kept int
+	for _, ids := range sets {
+		total += len(ids)
+	}
 	for f, ids := range sets {
-		cli.Select(f, false)
-		ss := new(imap.SeqSet)
-		ss.AddNum(ids...)
-		cli.Store(ss, imap.FormatFlagsOp(imap.AddFlags, true),
-			[]interface{}{imap.DeletedFlag}, nil)
-		cli.Expunge(nil)
+		if interrupted() {
+			break
+		}
+		if *moveF != "" && f == *moveF {
+			note("⏭  %d msgs already in %s", len(ids), f)
+			total -= len(ids)
+			continue
+		}
+		st, err := cli.Select(f, false)
+		if err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		if *keepFlagF {
+			n := len(ids)
+			ids = dropFlagged(cli, ids)
+			kept += n - len(ids)
+		}
+		if target == "" || f == target {
+			warnForeignDeleted(cli, f, ids)
+		}
+		var uids []uint32
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, u := range ids {
+			if ck.done(f, st.UidValidity, u) {
+				done++
+				continue
+			}
+			uids = append(uids, u)
+		}
+		for len(uids) > 0 && !interrupted() {
+			n := *delBatchF
+			if n <= 0 || n > len(uids) {
+				n = len(uids)
+			}
+			batch := uids[:n]
+			uids = uids[n:]
+			ss := new(imap.SeqSet)
+			ss.AddNum(batch...)
+			if safe != nil {
+				if err := safe.add(cli, f, ss); err != nil {
+					log.Printf("\nsafe backup %s: %v - stopping", f, err)
+					break
+				}
+			}
+			var recs []auditRec
+			if audit != nil {
+				recs = auditInfo(cli, f, ss)
+			}
+			if target != "" && f != target {
+				if err := cli.UidMove(ss, target); err != nil {
+					log.Printf("\nmove %s: %v", f, err)
+					break
+				}
+			} else {
+				// skip the STORE for messages a previous run already flagged
+				todo := pendingDelete(cli, ss)
+				if todo != nil && !todo.Empty() {
+					if err := cli.UidStore(todo, imap.FormatFlagsOp(imap.AddFlags, true),
+						[]interface{}{imap.DeletedFlag}, nil); err != nil {
+						log.Printf("\nstore %s: %v", f, err)
+						break
+					}
+				}
+				if err := expungeUIDs(cli, ss); err != nil {
+					log.Printf("\nexpunge %s: %v", f, err)
+					break
+				}
+			}
+			ck.mark(f, st.UidValidity, batch)
+			if audit != nil {
+				enc := json.NewEncoder(audit)
+				for _, r := range recs {
+					enc.Encode(r)
+				}
+			}
+			done += len(batch)
+			atomic.AddInt64(&runMetrics.deleted, int64(len(batch)))
+			if *moveF != "" {
+				progress("📂 moved %d of %d", done, total-kept)
+			} else {
+				progress("🗑  deleted %d of %d", done, total-kept)
+			}
+		}
+	}
+	progressDone()
+	if kept > 0 {
+		fmt.Printf("⭐ kept %d flagged\n", kept)
+	}
+	if *moveF != "" {
+		fmt.Printf("✓ moved %d msgs → %s\n", done, *moveF)
+	} else {
+		fmt.Printf("✓ deleted %d of %d\n", done, total-kept)
 	}
-	fmt.Println("✓ deleted")
 }
 
-/* ── TLS / connect helpers ─────────────────────────────── */
+// openAudit opens -log-file for appending; nil if unset or unusable.
+func openAudit() *os.File {
+	if *logFileF == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*logFileF, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("audit log:", err)
+		return nil
+	}
+	return f
+}
 
-func dialSmart(addr string) (*client.Client, error) {
-	host, port, _ := net.SplitHostPort(addr)
-	mod := &tls.Config{ServerName: host, InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}
-	leg := &tls.Config{ServerName: host, InsecureSkipVerify: true, MinVersion: tls.VersionTLS10,
-		CipherSuites: []uint16{
-			tls.TLS_RSA_WITH_RC4_128_SHA,
-			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA}}
-	connect := func(c *tls.Config) (*client.Client, error) {
-		switch port {
-		case "993":
-			return client.DialTLS(addr, c)
-		case "143":
-			cl, err := client.Dial(addr)
-			if err != nil {
-				return nil, err
+// markSets is wipe under -mark: it adds (read) or removes (unread) \Seen
+// in batches of -delete-batch and expunges nothing. -keep-flagged and
+// -log-file apply as for a delete; the audit lines carry the action.
+func markSets(cli *client.Client, sets map[string][]uint32, audit *os.File) {
+	var op imap.FlagsOp = imap.AddFlags
+	if *markF == "unread" {
+		op = imap.RemoveFlags
+	}
+	var done, kept int
+	for f, ids := range sets {
+		if interrupted() {
+			break
+		}
+		if _, err := cli.Select(f, false); err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		if *keepFlagF {
+			n := len(ids)
+			ids = dropFlagged(cli, ids)
+			kept += n - len(ids)
+		}
+		for len(ids) > 0 && !interrupted() {
+			n := *delBatchF
+			if n <= 0 || n > len(ids) {
+				n = len(ids)
 			}
-			if err = cl.StartTLS(c); err != nil {
-				cl.Logout()
-				return nil, err
+			ss := new(imap.SeqSet)
+			ss.AddNum(ids[:n]...)
+			ids = ids[n:]
+			var recs []auditRec
+			if audit != nil {
+				recs = auditInfo(cli, f, ss)
 			}
-			return cl, nil
+			if err := cli.UidStore(ss, imap.FormatFlagsOp(op, true), []interface{}{imap.SeenFlag}, nil); err != nil {
+				log.Printf("\nstore %s: %v", f, err)
+				break
+			}
+			if audit != nil {
+				enc := json.NewEncoder(audit)
+				for _, r := range recs {
+					r.Action = "mark " + *markF
+					enc.Encode(r)
+				}
+			}
+			done += n
+			progress("🏷  marked %d", done)
+		}
+	}
+	progressDone()
+	if kept > 0 {
+		fmt.Printf("⭐ kept %d flagged\n", kept)
+	}
+	if op == imap.AddFlags {
+		fmt.Printf("✓ marked %d messages \\Seen\n", done)
+	} else {
+		fmt.Printf("✓ marked %d messages unread (\\Seen removed)\n", done)
+	}
+}
+
+// gmailTrash returns the Trash folder on Gmail, where \Deleted+EXPUNGE
+// only drops a label and the mail stays in All Mail; "" elsewhere.
+func gmailTrash(cli *client.Client) string {
+	if ok, _ := cli.Support("X-GM-EXT-1"); !ok {
+		return ""
+	}
+	if t := findSpecial(cli, imap.TrashAttr); t != "" {
+		return t
+	}
+	return "[Gmail]/Trash"
+}
+
+// findSpecial returns the first mailbox with the given special-use attribute.
+func findSpecial(cli *client.Client, attr string) string {
+	var found string
+	mbc := make(chan *imap.MailboxInfo, 64)
+	go func() { _ = cli.List("", "*", mbc) }()
+	for mb := range mbc {
+		for _, a := range mb.Attributes {
+			if a == attr && found == "" {
+				found = mb.Name
+			}
+		}
+	}
+	return found
+}
+
+// pendingDelete narrows uids to those not yet flagged \Deleted; on a
+// SEARCH failure it returns uids unchanged.
+func pendingDelete(cli *client.Client, uids *imap.SeqSet) *imap.SeqSet {
+	crit := imap.NewSearchCriteria()
+	crit.Uid = uids
+	crit.WithoutFlags = []string{imap.DeletedFlag}
+	left, err := cli.UidSearch(crit)
+	if err != nil {
+		return uids
+	}
+	out := new(imap.SeqSet)
+	out.AddNum(left...)
+	return out
+}
+
+// expungeUIDs removes uids, already \Deleted, from the selected folder:
+// UID EXPUNGE of just those with UIDPLUS, else a plain EXPUNGE, which
+// also takes any other \Deleted mail (see warnForeignDeleted).
+func expungeUIDs(cli *client.Client, uids *imap.SeqSet) error {
+	if ok, _ := cli.Support("UIDPLUS"); !ok {
+		return cli.Expunge(nil)
+	}
+	st, err := cli.Execute(&rawCmd{"UID", []interface{}{imap.RawString("EXPUNGE"), uids}}, nil)
+	if err == nil {
+		err = st.Err()
+	}
+	return err
+}
+
+// warnForeignDeleted says so when the selected folder holds \Deleted mail
+// outside ids and, lacking UIDPLUS, expungeUIDs would remove it as well.
+func warnForeignDeleted(cli *client.Client, folder string, ids []uint32) {
+	if ok, _ := cli.Support("UIDPLUS"); ok {
+		return
+	}
+	crit := imap.NewSearchCriteria()
+	crit.WithFlags = []string{imap.DeletedFlag}
+	del, err := search(cli, crit)
+	if err != nil {
+		return
+	}
+	mine := map[uint32]bool{}
+	for _, u := range ids {
+		mine[u] = true
+	}
+	n := 0
+	for _, u := range del {
+		if !mine[u] {
+			n++
+		}
+	}
+	if n > 0 {
+		fmt.Printf("⚠️  %s already holds %d other \\Deleted msgs; without UIDPLUS the expunge removes them too\n", folder, n)
+	}
+}
+
+// printUIDs writes "folder<TAB>uid" lines for sets to w.
+func printUIDs(w io.Writer, sets map[string][]uint32) {
+	var names []string
+	for f := range sets {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	for _, f := range names {
+		uids := append([]uint32(nil), sets[f]...)
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		for _, u := range uids {
+			fmt.Fprintf(w, "%s\t%d\n", f, u)
+		}
+	}
+}
+
+func countSets(sets map[string][]uint32) int {
+	var n int
+	for _, ids := range sets {
+		n += len(ids)
+	}
+	return n
+}
+
+// loadUIDFile reads "folder<TAB>uid" lines, as written by -print-uids.
+func loadUIDFile(path string) (map[string][]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sets := map[string][]uint32{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fold, id, ok := strings.Cut(line, "\t")
+		u, err := strconv.ParseUint(id, 10, 32)
+		if !ok || err != nil || u == 0 {
+			return nil, fmt.Errorf("%s:%d: want folder<TAB>uid", path, n)
+		}
+		sets[fold] = append(sets[fold], uint32(u))
+	}
+	return sets, sc.Err()
+}
+
+// existingUIDs keeps the per-folder UIDs that still exist.
+func existingUIDs(cli *client.Client, uids map[string][]uint32) map[string][]uint32 {
+	out := map[string][]uint32{}
+	for f, ids := range uids {
+		if _, err := cli.Select(f, false); err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		crit := imap.NewSearchCriteria()
+		crit.Uid = new(imap.SeqSet)
+		crit.Uid.AddNum(ids...)
+		if left, err := search(cli, crit); err != nil {
+			log.Printf("search %s: %v", f, err)
+		} else if len(left) > 0 {
+			out[f] = left
+		}
+	}
+	return out
+}
+
+// deleteUIDFile deletes the messages listed in a -uids-file after showing
+// per-folder totals and asking once.
+func deleteUIDFile(cli *client.Client, path string) error {
+	uids, err := loadUIDFile(path)
+	if err != nil {
+		return err
+	}
+	sets := existingUIDs(cli, uids)
+	var names []string
+	for f := range uids {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	fmt.Printf("\n%-35s %8s %8s\n", "Folder", "listed", "found")
+	for _, f := range names {
+		fmt.Printf("%-35s %8d %8d\n", f, len(uids[f]), len(sets[f]))
+	}
+	fmt.Printf("Total: %d listed, %d found\n", countSets(uids), countSets(sets))
+	if countSets(sets) == 0 {
+		fmt.Println("Nothing to delete")
+		return nil
+	}
+	if *confSumF {
+		blastRadius(cli, sets)
+	}
+	if confirmDelete(action() + "? (y/N): ") {
+		wipe(cli, sets)
+	}
+	return nil
+}
+
+/* ── delete plans (-export-plan / -execute-plan) ──────── */
+
+// deletePlan is what -export-plan writes: every message a run would have
+// deleted, with the folder's UIDVALIDITY so -execute-plan can tell when
+// the UIDs no longer mean the same messages.
+type deletePlan struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Email   string       `json:"email"`
+	Move    string       `json:"move,omitempty"` // -move target; empty = delete
+	Folders []planFolder `json:"folders"`
+}
+
+type planFolder struct {
+	Folder      string     `json:"folder"`
+	UidValidity uint32     `json:"uidvalidity"`
+	Messages    []auditRec `json:"messages"`
+}
+
+// plan collects the sets of every dry-run wipe of this run; the stats
+// table may confirm several buckets one after another.
+var plan = map[string]*planFolder{}
+
+func planMsgs() int {
+	n := 0
+	for _, pf := range plan {
+		n += len(pf.Messages)
+	}
+	return n
+}
+
+// exportPlan adds sets to the plan and rewrites -export-plan.
+func exportPlan(cli *client.Client, sets map[string][]uint32) error {
+	for f, ids := range sets {
+		if len(ids) == 0 {
+			continue
+		}
+		st, err := cli.Select(f, true)
+		if err != nil {
+			return fmt.Errorf("select %s: %w", f, err)
+		}
+		pf := plan[f]
+		if pf == nil {
+			pf = &planFolder{Folder: f, UidValidity: st.UidValidity}
+			plan[f] = pf
+		}
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		pf.Messages = append(pf.Messages, auditInfo(cli, f, ss)...)
+	}
+	p := deletePlan{Version: 1, Created: time.Now().UTC(), Email: *emailF, Move: *moveF}
+	for _, pf := range plan {
+		p.Folders = append(p.Folders, *pf)
+	}
+	sort.Slice(p.Folders, func(i, j int) bool { return p.Folders[i].Folder < p.Folders[j].Folder })
+	raw, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*planOutF, append(raw, '\n'), 0600)
+}
+
+// executePlan deletes (or moves) what an -export-plan file lists. Folders
+// whose UIDVALIDITY changed are skipped whole, and UIDs that no longer
+// exist are dropped; per-folder totals are shown before the one prompt.
+func executePlan(cli *client.Client, path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p deletePlan
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if p.Version != 1 {
+		return fmt.Errorf("%s: plan version %d not supported", path, p.Version)
+	}
+	if !strings.EqualFold(p.Email, *emailF) {
+		return fmt.Errorf("%s was made for %s, not %s", path, p.Email, *emailF)
+	}
+	if p.Move != "" {
+		*moveF = p.Move
+	}
+	fmt.Printf("📋 plan of %s: %s\n", p.Created.Local().Format("2006-01-02 15:04"), strings.ToLower(action()))
+	listed := map[string][]uint32{}
+	var stale []string
+	for _, pf := range p.Folders {
+		st, err := cli.Status(pf.Folder, []imap.StatusItem{imap.StatusUidValidity})
+		if err != nil || st.UidValidity != pf.UidValidity {
+			stale = append(stale, pf.Folder)
+			continue
+		}
+		for _, m := range pf.Messages {
+			listed[pf.Folder] = append(listed[pf.Folder], m.UID)
+		}
+	}
+	sets := existingUIDs(cli, listed)
+	fmt.Printf("\n%-35s %8s %8s\n", "Folder", "planned", "found")
+	for _, pf := range p.Folders {
+		if len(listed[pf.Folder]) > 0 {
+			fmt.Printf("%-35s %8d %8d\n", pf.Folder, len(listed[pf.Folder]), len(sets[pf.Folder]))
+		}
+	}
+	for _, f := range stale {
+		fmt.Printf("⚠️  %s: missing or UIDVALIDITY changed since the plan, skipped\n", f)
+	}
+	fmt.Printf("Total: %d planned, %d found\n", countSets(listed), countSets(sets))
+	if countSets(sets) == 0 {
+		fmt.Println("Nothing to delete")
+		return nil
+	}
+	if *confSumF {
+		blastRadius(cli, sets)
+	}
+	if confirmDelete(action() + "? (y/N): ") {
+		wipe(cli, sets)
+	}
+	return nil
+}
+
+// blastRadius prints the top senders and folders of a delete (or move,
+// or mark) set so a broad criterion's surprises show up before the prompt.
+func blastRadius(cli *client.Client, sets map[string][]uint32) {
+	const top = 10
+	senders := map[string]int{}
+	folders := map[string]int{}
+	for f, ids := range sets {
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := cli.Select(f, true); err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		folders[f] = len(ids)
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		mc := make(chan *imap.Message, 32)
+		go func() { _ = fetchBulk(cli, ss, []imap.FetchItem{imap.FetchEnvelope}, mc) }()
+		for m := range mc {
+			senders[classify(m, "from")]++
+		}
+	}
+	show := func(title string, c map[string]int) {
+		keys := make([]string, 0, len(c))
+		for k := range c {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return c[keys[i]] > c[keys[j]] })
+		fmt.Printf("Top %s:\n", title)
+		for i, k := range keys {
+			if i == top {
+				fmt.Printf("  … and %d more\n", len(keys)-top)
+				break
+			}
+			fmt.Printf("  %-40s %6d\n", trim(k), c[k])
+		}
+	}
+	fmt.Printf("\nAbout to %s %d msgs\n", strings.ToLower(action()), countSets(sets))
+	show("senders", senders)
+	show("folders", folders)
+}
+
+// keepLatest returns sets without its k most recent messages (by
+// INTERNALDATE, across all folders), i.e. what -keep-latest deletes.
+// perSender keeps k for each sender instead, as a stats bucket would: a
+// match set spans many senders.
+func keepLatest(cli *client.Client, sets map[string][]uint32, k int, perSender bool) map[string][]uint32 {
+	type ref struct {
+		folder string
+		id     uint32
+		when   time.Time
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+	if perSender {
+		items = append(items, imap.FetchEnvelope)
+	}
+	groups := map[string][]ref{}
+	for f, ids := range sets {
+		if _, err := cli.Select(f, false); err != nil || len(ids) == 0 {
+			continue
+		}
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		mc := make(chan *imap.Message, 32)
+		go func() { _ = cli.UidFetch(ss, items, mc) }()
+		for m := range mc {
+			key := ""
+			if perSender {
+				key = strings.ToLower(classify(m, "from"))
+			}
+			groups[key] = append(groups[key], ref{f, m.Uid, m.InternalDate})
+		}
+	}
+	out := map[string][]uint32{}
+	for _, all := range groups {
+		sort.Slice(all, func(i, j int) bool { return all[i].when.After(all[j].when) })
+		for i, r := range all {
+			if i >= k {
+				out[r.folder] = append(out[r.folder], r.id)
+			}
+		}
+	}
+	return out
+}
+
+// keepRecent drops messages whose INTERNALDATE is after -keep-recent's
+// cutoff from sets and reports how many were preserved. Without the flag
+// sets is returned unchanged.
+func keepRecent(cli *client.Client, sets map[string][]uint32) map[string][]uint32 {
+	if recentCut.IsZero() {
+		return sets
+	}
+	out := map[string][]uint32{}
+	kept := 0
+	for f, ids := range sets {
+		if _, err := cli.Select(f, false); err != nil || len(ids) == 0 {
+			continue
+		}
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		mc := make(chan *imap.Message, 32)
+		go func() { _ = cli.UidFetch(ss, []imap.FetchItem{imap.FetchInternalDate}, mc) }()
+		for m := range mc {
+			if m.InternalDate.After(recentCut) {
+				kept++
+				continue
+			}
+			out[f] = append(out[f], m.Uid)
+		}
+	}
+	if kept > 0 {
+		fmt.Printf("Preserved %d msgs newer than %s (-keep-recent)\n", kept, *keepRecF)
+	}
+	return out
+}
+
+// withoutFlagged is dropFlagged over every folder of sets, selected read-only;
+// it also returns how many messages were dropped.
+func withoutFlagged(cli *client.Client, sets map[string][]uint32) (map[string][]uint32, int) {
+	out := map[string][]uint32{}
+	kept := 0
+	for f, ids := range sets {
+		if _, err := cli.Select(f, true); err != nil || len(ids) == 0 {
+			continue
+		}
+		out[f] = dropFlagged(cli, ids)
+		kept += len(ids) - len(out[f])
+	}
+	return out, kept
+}
+
+// dropFlagged removes \Flagged messages from ids in the selected folder.
+func dropFlagged(cli *client.Client, ids []uint32) []uint32 {
+	ss := new(imap.SeqSet)
+	ss.AddNum(ids...)
+	flagged := map[uint32]bool{}
+	mc := make(chan *imap.Message, 32)
+	go func() { _ = cli.UidFetch(ss, []imap.FetchItem{imap.FetchFlags}, mc) }()
+	for m := range mc {
+		for _, fl := range m.Flags {
+			if fl == imap.FlaggedFlag {
+				flagged[m.Uid] = true
+			}
+		}
+	}
+	var out []uint32
+	for _, id := range ids {
+		if !flagged[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+/* ── pre-delete backup (-safe) ────────────────────────── */
+
+type safeArchive struct {
+	path string
+	f    *os.File
+	gw   *gzip.Writer
+	tw   *tar.Writer
+}
+
+func newSafeArchive() (*safeArchive, error) {
+	path := "imap-safe-" + time.Now().Format("20060102-150405") + ".tgz"
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	gw := gzip.NewWriter(f)
+	note("🛟 safe backup → %s", path)
+	return &safeArchive{path: path, f: f, gw: gw, tw: tar.NewWriter(gw)}, nil
+}
+
+// add archives the given UIDs of the selected folder in backup format and
+// flushes, so the copy is on disk before the caller expunges.
+func (a *safeArchive) add(cli *client.Client, folder string, uids *imap.SeqSet) error {
+	delim := serverDelim(cli)
+	mc := make(chan *imap.Message, 32)
+	done := make(chan error, 1)
+	go func() {
+		done <- withTimeout(cli, 0, func() error {
+			return cli.UidFetch(uids, entryItems, mc)
+		})
+	}()
+	var werr error
+	for m := range mc {
+		data, _ := io.ReadAll(m.GetBody(&imap.BodySectionName{}))
+		h := entryHeader(folder, delim, cli.Mailbox().UidValidity, m, data)
+		if err := a.tw.WriteHeader(h); err != nil && werr == nil {
+			werr = err
+		}
+		if _, err := a.tw.Write(data); err != nil && werr == nil {
+			werr = err
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	a.tw.Flush()
+	if err := a.gw.Flush(); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *safeArchive) close() {
+	a.tw.Close()
+	a.gw.Close()
+	a.f.Close()
+	fmt.Println("🛟 restore with: -restore", a.path)
+}
+
+/* ── .eml export (-export) ────────────────────────────── */
+
+// exportEML writes every message of sets to dir/<folder>/<uid>.eml, the
+// folder split into directories at the server delimiter. The files get
+// INTERNALDATE as their mtime; folders are selected read-only.
+func exportEML(cli *client.Client, dir string, sets map[string][]uint32) error {
+	delim := serverDelim(cli)
+	var n int
+	for f, ids := range sets {
+		if interrupted() {
+			return fmt.Errorf("export interrupted")
+		}
+		sub := exportPath(dir, f, delim)
+		if err := os.MkdirAll(sub, 0700); err != nil {
+			return err
+		}
+		if _, err := cli.Select(f, true); err != nil {
+			return fmt.Errorf("select %s: %w", f, err)
+		}
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		mc := make(chan *imap.Message, 32)
+		done := make(chan error, 1)
+		go func() { done <- fetchBulk(cli, ss, entryItems, mc) }()
+		var werr error
+		for m := range mc {
+			data, _ := io.ReadAll(m.GetBody(&imap.BodySectionName{}))
+			path := filepath.Join(sub, fmt.Sprintf("%d.eml", m.Uid))
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				if werr == nil {
+					werr = err
+				}
+				continue
+			}
+			if !m.InternalDate.IsZero() {
+				os.Chtimes(path, m.InternalDate, m.InternalDate)
+			}
+			n++
+			progress("💾 exported %d", n)
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		if werr != nil {
+			return werr
+		}
+	}
+	progressDone()
+	fmt.Printf("💾 exported %d msgs → %s\n", n, dir)
+	return nil
+}
+
+/* ── attachment stripping (-strip-attachments) ────────── */
+
+// exportPath is dir/<folder>, the folder split into directories at the
+// server delimiter; names are cleaned so nothing lands outside dir.
+func exportPath(dir, folder, delim string) string {
+	parts := []string{folder}
+	if delim != "" {
+		parts = strings.Split(folder, delim)
+	}
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			p = "_"
+		}
+		parts[i] = strings.ReplaceAll(p, string(os.PathSeparator), "_")
+	}
+	return filepath.Join(append([]string{dir}, parts...)...)
+}
+
+// bigPart reports whether a leaf MIME part is an attachment worth
+// stripping: at least stripMin encoded octets and not a message text
+// (text/* without a file name stays).
+func bigPart(mediaType string, size int64, filename string, attachment bool) bool {
+	if size < stripMin {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") && !attachment && filename == "" {
+		return false
+	}
+	return true
+}
+
+// stripCandidate is a message with parts above -min-size, as found by
+// BODYSTRUCTURE before anything is fetched in full.
+type stripCandidate struct {
+	UID     uint32
+	Date    time.Time
+	Subject string
+	Size    uint32
+	Parts   int
+	Bytes   int64 // encoded octets of those parts
+}
+
+// bigParts counts the strippable leaves of a BODYSTRUCTURE.
+func bigParts(bs *imap.BodyStructure) (n int, size int64) {
+	if bs == nil {
+		return 0, 0
+	}
+	if strings.EqualFold(bs.MIMEType, "multipart") {
+		for _, p := range bs.Parts {
+			pn, ps := bigParts(p)
+			n, size = n+pn, size+ps
+		}
+		return n, size
+	}
+	mt := strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType)
+	name, _ := bs.Filename()
+	if bigPart(mt, int64(bs.Size), name, strings.EqualFold(bs.Disposition, "attachment")) {
+		return 1, int64(bs.Size)
+	}
+	return 0, 0
+}
+
+// strippedPart is an attachment cut out of a message and saved to Path.
+type strippedPart struct {
+	Name string
+	Path string
+	Size int64 // decoded bytes written
+}
+
+// stripMessage returns raw with every bigPart replaced by a short
+// text/plain stub naming the file it was saved to under dir. Headers
+// and all other parts are copied byte for byte.
+func stripMessage(raw []byte, dir string, uid uint32) ([]byte, []strippedPart, error) {
+	nl := "\n"
+	if bytes.Contains(raw, []byte("\r\n")) {
+		nl = "\r\n"
+	}
+	var saved []strippedPart
+	var walk func(part []byte) ([]byte, error)
+	walk = func(part []byte) ([]byte, error) {
+		hdr, body := splitHeader(part)
+		h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(hdr))).ReadMIMEHeader()
+		if err != nil && len(h) == 0 {
+			return part, nil // not a header we understand: leave it
+		}
+		mt, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if mt == "" {
+			mt = "text/plain"
+		}
+		if strings.HasPrefix(mt, "multipart/") && params["boundary"] != "" {
+			nb, err := mapParts(body, params["boundary"], walk)
+			if err != nil {
+				return nil, err
+			}
+			return append(append([]byte{}, hdr...), nb...), nil
+		}
+		disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+		name := dparams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		if dec, err := (&mime.WordDecoder{CharsetReader: imap.CharsetReader}).DecodeHeader(name); err == nil {
+			name = dec
+		}
+		if !bigPart(mt, int64(len(body)), name, disp == "attachment") {
+			return part, nil
+		}
+		data, err := decodePart(body, h.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %w", mt, err)
+		}
+		if name == "" {
+			name = "part.bin"
+			if ext, _ := mime.ExtensionsByType(mt); len(ext) > 0 {
+				name = "part" + ext[0]
+			}
+		}
+		dst := filepath.Join(dir, fmt.Sprintf("%d-%d-%s", uid, len(saved)+1, path.Base(strings.ReplaceAll(name, "\\", "/"))))
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			return nil, err
+		}
+		saved = append(saved, strippedPart{name, dst, int64(len(data))})
+		stub := strings.Join([]string{
+			"Content-Type: text/plain; charset=utf-8",
+			"Content-Disposition: inline",
+			"",
+			fmt.Sprintf("[attachment removed: %s (%.1f MB, %s), saved to %s]", name, float64(len(data))/(1024*1024), mt, dst),
+		}, nl)
+		return []byte(stub), nil
+	}
+	out, err := walk(raw)
+	return out, saved, err
+}
+
+// splitHeader cuts a MIME entity after its blank line; the header keeps
+// its final line break.
+func splitHeader(b []byte) (hdr, body []byte) {
+	for _, nl := range []string{"\r\n", "\n"} { // no header lines at all
+		if bytes.HasPrefix(b, []byte(nl)) {
+			return b[:len(nl)], b[len(nl):]
+		}
+	}
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(b, []byte(sep)); i >= 0 {
+			return b[:i+len(sep)], b[i+len(sep):]
+		}
+	}
+	return b, nil
+}
+
+// mapParts rewrites each part of a multipart body with fn, leaving the
+// preamble, delimiter lines and epilogue as they were.
+func mapParts(body []byte, boundary string, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	delim := []byte("--" + boundary)
+	// offsets of delimiter lines: at the start or right after a newline
+	var at []int
+	for i := 0; i+len(delim) <= len(body); {
+		j := bytes.Index(body[i:], delim)
+		if j < 0 {
+			break
+		}
+		j += i
+		if j == 0 || body[j-1] == '\n' {
+			at = append(at, j)
+		}
+		i = j + len(delim)
+	}
+	if len(at) < 2 {
+		return body, nil // malformed: keep it whole
+	}
+	var out []byte
+	out = append(out, body[:at[0]]...)
+	for k := 0; k+1 < len(at); k++ {
+		line := at[k]
+		eol := bytes.IndexByte(body[line:], '\n')
+		if eol < 0 || line+eol+1 > at[k+1] {
+			return body, nil
+		}
+		start := line + eol + 1
+		end := at[k+1] // the newline before the next delimiter belongs to it
+		if end > start && body[end-1] == '\n' {
+			end--
+			if end > start && body[end-1] == '\r' {
+				end--
+			}
+		}
+		np, err := fn(body[start:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, body[line:start]...)
+		out = append(out, np...)
+		out = append(out, body[end:at[k+1]]...)
+	}
+	return append(out, body[at[len(at)-1]:]...), nil
+}
+
+// decodePart undoes a Content-Transfer-Encoding.
+func decodePart(body []byte, cte string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body))))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// stripAttachments saves the large attachments of the matched messages
+// under -export, appends a copy of each message with those parts
+// replaced by a stub (same flags and INTERNALDATE, headers untouched)
+// and then deletes the original. That delete is its own STORE and
+// expunge right after the append, not wipe: -move, -keep-flagged or
+// -checkpoint would leave two copies or strand the stripped one.
+func stripAttachments(cli *client.Client, sets map[string][]uint32) error {
+	var names []string
+	for f := range sets {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	cands := map[string][]stripCandidate{}
+	var msgs, parts int
+	var bytesOut int64
+	for _, f := range names {
+		if _, err := cli.Select(f, true); err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		crit := imap.NewSearchCriteria()
+		crit.Uid = new(imap.SeqSet)
+		crit.Uid.AddNum(sets[f]...)
+		crit.Larger = uint32(stripMin)
+		ids, err := search(cli, crit)
+		if err != nil {
+			log.Printf("search %s: %v", f, err)
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		ss := new(imap.SeqSet)
+		ss.AddNum(ids...)
+		mc := make(chan *imap.Message, 32)
+		done := make(chan error, 1)
+		go func() {
+			done <- fetchBulk(cli, ss, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchBodyStructure}, mc)
+		}()
+		for m := range mc {
+			n, b := bigParts(m.BodyStructure)
+			if n == 0 {
+				continue
+			}
+			cands[f] = append(cands[f], stripCandidate{m.Uid, dateOf(m), subjectOf(m), m.Size, n, b})
+			msgs++
+			parts += n
+			bytesOut += b
+		}
+		if err := <-done; err != nil {
+			log.Printf("fetch %s: %v", f, err)
+		}
+		sort.Slice(cands[f], func(i, j int) bool { return cands[f][i].UID < cands[f][j].UID })
+	}
+	if msgs == 0 {
+		fmt.Printf("No matching message has an attachment of %s or more\n", *stripMinF)
+		return nil
+	}
+	fmt.Printf("\nAttachments of %s or more\n", *stripMinF)
+	for _, f := range names {
+		for _, c := range cands[f] {
+			fmt.Printf("  %-20s %s  %-40s %7.1f MB → ~%.1f MB  (%d parts)\n", trim(f), c.Date.Format("2006-01-02"), trim(c.Subject),
+				float64(c.Size)/(1024*1024), float64(int64(c.Size)-c.Bytes)/(1024*1024), c.Parts)
+		}
+	}
+	fmt.Printf("Total: %d attachments in %d msgs, about %.1f MB to free; saved under %s\n", parts, msgs, float64(bytesOut)/(1024*1024), *exportF)
+	if *dryRunF {
+		fmt.Println("DRY RUN — nothing changed")
+		return nil
+	}
+	if !confirmDelete(fmt.Sprintf("Rewrite %d msgs without these attachments and delete the originals? (y/N): ", msgs)) {
+		return nil
+	}
+	delim := serverDelim(cli)
+	var freed int64
+	for _, f := range names {
+		if len(cands[f]) == 0 {
+			continue
+		}
+		dir := exportPath(*exportF, f, delim)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if _, err := cli.Select(f, false); err != nil {
+			log.Printf("select %s: %v", f, err)
+			continue
+		}
+		var ids []uint32
+		for _, c := range cands[f] {
+			ids = append(ids, c.UID)
+		}
+		warnForeignDeleted(cli, f, ids)
+		for _, c := range cands[f] {
+			if interrupted() {
+				break
+			}
+			ss := new(imap.SeqSet)
+			ss.AddNum(c.UID)
+			mc := make(chan *imap.Message, 1)
+			done := make(chan error, 1)
+			go func() { done <- cli.UidFetch(ss, entryItems, mc) }()
+			m := <-mc
+			for range mc {
+			}
+			if err := <-done; err != nil || m == nil {
+				log.Printf("%s uid %d: fetch: %v", f, c.UID, err)
+				continue
+			}
+			raw, _ := io.ReadAll(m.GetBody(&imap.BodySectionName{}))
+			out, saved, err := stripMessage(raw, dir, c.UID)
+			if err != nil {
+				log.Printf("%s uid %d: %v - left as is", f, c.UID, err)
+				continue
+			}
+			if len(saved) == 0 {
+				continue
+			}
+			var flags []string
+			for _, fl := range m.Flags {
+				if !strings.EqualFold(fl, imap.RecentFlag) && !strings.EqualFold(fl, imap.DeletedFlag) {
+					flags = append(flags, fl)
+				}
+			}
+			if _, err := appendRetry(cli, f, appendMsg{Name: fmt.Sprintf("%s/%d", f, c.UID), Flags: flags, Date: m.InternalDate, Data: out}); err != nil {
+				log.Printf("%s uid %d: append: %v - original kept", f, c.UID, err)
+				continue
+			}
+			err = cli.UidStore(ss, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+			if err == nil {
+				err = expungeUIDs(cli, ss)
+			}
+			if err != nil {
+				log.Printf("%s uid %d: delete: %v - both copies kept", f, c.UID, err)
+				continue
+			}
+			atomic.AddInt64(&runMetrics.deleted, 1)
+			freed += int64(len(raw) - len(out))
+			fmt.Printf("  %s uid %d: %.1f MB → %.1f MB, %d saved\n", f, c.UID,
+				float64(len(raw))/(1024*1024), float64(len(out))/(1024*1024), len(saved))
+		}
+		if interrupted() {
+			break
+		}
+	}
+	fmt.Printf("✂️  freed %.1f MB\n", float64(freed)/(1024*1024))
+	return nil
+}
+
+/* ── delete checkpoint (-checkpoint) ──────────────────── */
+
+// checkpoint remembers "folder<TAB>uidvalidity<TAB>uid" of every expunged
+// batch so a re-run after an interruption skips what is already gone.
+type checkpoint struct {
+	f    *os.File
+	seen map[string]bool
+}
+
+func ckKey(folder string, v, uid uint32) string {
+	return fmt.Sprintf("%s\t%d\t%d", folder, v, uid)
+}
+
+func loadCheckpoint(path string) *checkpoint {
+	ck := &checkpoint{seen: map[string]bool{}}
+	if path == "" {
+		return ck
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		for _, ln := range strings.Split(string(data), "\n") {
+			if ln != "" {
+				ck.seen[ln] = true
+			}
+		}
+		if len(ck.seen) > 0 {
+			note("↩️  checkpoint: %d already deleted", len(ck.seen))
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("checkpoint:", err)
+		return ck
+	}
+	ck.f = f
+	return ck
+}
+
+func (ck *checkpoint) done(folder string, v, uid uint32) bool {
+	return ck.seen[ckKey(folder, v, uid)]
+}
+
+func (ck *checkpoint) mark(folder string, v uint32, uids []uint32) {
+	if ck.f == nil {
+		return
+	}
+	var sb strings.Builder
+	for _, u := range uids {
+		sb.WriteString(ckKey(folder, v, u) + "\n")
+	}
+	ck.f.WriteString(sb.String())
+	ck.f.Sync()
+}
+
+func (ck *checkpoint) close() {
+	if ck.f != nil {
+		ck.f.Close()
+	}
+}
+
+/* ── scan resume (-scan-resume) ───────────────────────── */
+
+// scanState caches finished folders of a stats scan. A folder's buckets
+// are reused only while UIDVALIDITY, UIDNEXT and MESSAGES are all
+// unchanged, i.e. nothing arrived or was expunged since.
+type scanState struct {
+	path    string
+	Sig     string // the options that shape buckets
+	Folders map[string]*folderState
+}
+
+type folderState struct {
+	UidValidity, UidNext, Messages uint32
+	Buckets                        map[string]*bucket
+}
+
+func scanSig() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%t|%t|%t|%t|%t|%d", *fieldF, *matchHdrF, *betweenF, *olderF, *newerF, *byFoldF, *inclDelF, *fastF, *hdrFbF, *exclSelfF, *limitF)
+}
+
+func loadScanState(path string) *scanState {
+	rs := &scanState{path: path, Sig: scanSig(), Folders: map[string]*folderState{}}
+	f, err := os.Open(path)
+	if err != nil {
+		return rs
+	}
+	defer f.Close()
+	var old scanState
+	if err := gob.NewDecoder(f).Decode(&old); err != nil {
+		log.Println("scan-resume:", err, "- starting over")
+	} else if old.Sig != rs.Sig {
+		note("↩️  scan-resume: options changed, starting over")
+	} else {
+		rs.Folders = old.Folders
+		note("↩️  scan-resume: %d folders cached", len(rs.Folders))
+	}
+	return rs
+}
+
+// begin returns folder's cached state and true when it is still valid,
+// else a fresh state to fill during the scan.
+func (rs *scanState) begin(cli *client.Client, folder string) (*folderState, bool) {
+	cur := &folderState{Buckets: map[string]*bucket{}}
+	st, err := cli.Status(folder, []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages})
+	if err != nil {
+		return cur, false
+	}
+	cur.UidValidity, cur.UidNext, cur.Messages = st.UidValidity, st.UidNext, st.Messages
+	if c := rs.Folders[folder]; c != nil && c.UidValidity == cur.UidValidity &&
+		c.UidNext == cur.UidNext && c.Messages == cur.Messages {
+		return c, true
+	}
+	return cur, false
+}
+
+func (fs *folderState) add(folder, key string, uid uint32, sz int64) {
+	if fs.Buckets[key] == nil {
+		fs.Buckets[key] = &bucket{Key: key, ByFolder: map[string][]uint32{}}
+	}
+	fs.Buckets[key].add(folder, uid, sz)
+}
+
+// finish records a fully scanned folder and rewrites the state file.
+func (rs *scanState) finish(folder string, fs *folderState) {
+	rs.Folders[folder] = fs
+	tmp := rs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Println("scan-resume:", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(rs)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, rs.path)
+	}
+	if err != nil {
+		log.Println("scan-resume:", err)
+	}
+}
+
+/* ── resume token (-resume-token) ────────────────────── */
+
+// resumeToken records which folders, and for a folder a run stopped in
+// which UIDs, are already scanned, so a later run (possibly elsewhere)
+// can skip them. It travels as tokenPrefix + base64url(JSON): short
+// enough for a command line, readable once decoded, and versioned.
+type resumeToken struct {
+	V       int                    `json:"v"`
+	Email   string                 `json:"email"`
+	Sig     string                 `json:"sig"` // options that decide what a scan yields
+	Folders map[string]tokenFolder `json:"folders"`
+}
+
+type tokenFolder struct {
+	UidValidity uint32 `json:"uidvalidity"`
+	Done        string `json:"done,omitempty"` // UID set scanned; empty: all of it
+}
+
+const tokenPrefix = "imapt1."
+
+func tokenSig(statsMode bool) string {
+	return fmt.Sprintf("%t|%s|%s", statsMode, scanSig(), matchDesc())
+}
+
+func parseResumeToken(s string) (*resumeToken, error) {
+	if !strings.HasPrefix(s, tokenPrefix) {
+		return nil, fmt.Errorf("not a resume token (want %s…)", tokenPrefix)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, tokenPrefix))
+	if err != nil {
+		return nil, err
+	}
+	var t resumeToken
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	if t.V != 1 {
+		return nil, fmt.Errorf("token version %d not supported", t.V)
+	}
+	return &t, nil
+}
+
+func (t *resumeToken) String() string {
+	raw, _ := json.Marshal(t)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// skipFor returns the UIDs of folder an earlier run scanned and whether
+// the folder was finished. A changed UIDVALIDITY voids the entry.
+func (t *resumeToken) skipFor(cli *client.Client, folder string) (map[uint32]bool, bool) {
+	tf, ok := t.Folders[folder]
+	if !ok {
+		return nil, false
+	}
+	st, err := cli.Status(folder, []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil || st.UidValidity != tf.UidValidity {
+		delete(t.Folders, folder)
+		return nil, false
+	}
+	if tf.Done == "" {
+		return nil, true
+	}
+	set, err := imap.ParseSeqSet(tf.Done)
+	if err != nil {
+		return nil, false
+	}
+	done := map[uint32]bool{}
+	for _, sq := range set.Set {
+		for u := sq.Start; u <= sq.Stop && u != 0; u++ {
+			done[u] = true
+		}
+	}
+	return done, false
+}
+
+// record notes what the scan of folder got through.
+func (t *resumeToken) record(cli *client.Client, folder string, seen map[uint32]bool, complete bool) {
+	mb := cli.Mailbox()
+	if mb == nil || mb.Name != folder || (!complete && len(seen) == 0) {
+		return
+	}
+	tf := tokenFolder{UidValidity: mb.UidValidity}
+	if !complete {
+		set := new(imap.SeqSet)
+		for u := range seen {
+			set.AddNum(u)
+		}
+		tf.Done = set.String()
+	}
+	t.Folders[folder] = tf
+}
+
+/* ── audit log (-log-file) ─────────────────────────────── */
+
+type auditRec struct {
+	Time    time.Time `json:"time"`
+	Folder  string    `json:"folder"`
+	UID     uint32    `json:"uid"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Size    uint32    `json:"size"`
+	Action  string    `json:"action,omitempty"` // -mark only; a delete leaves it out
+}
+
+// auditInfo fetches what the audit trail records about the given UIDs.
+func auditInfo(cli *client.Client, folder string, uids *imap.SeqSet) []auditRec {
+	var out []auditRec
+	mc := make(chan *imap.Message, 32)
+	go func() {
+		_ = cli.UidFetch(uids, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size}, mc)
+	}()
+	now := time.Now().UTC()
+	for m := range mc {
+		r := auditRec{Time: now, Folder: folder, UID: m.Uid, From: classify(m, "from"), Size: m.Size}
+		if m.Envelope != nil {
+			r.Subject = m.Envelope.Subject
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+/* ── streaming output (-stream-json) ──────────────────── */
+
+// streamRec is one -stream-json line. Key is the stats bucket the message
+// fell into; it is empty in match mode.
+type streamRec struct {
+	Folder  string    `json:"folder"`
+	UID     uint32    `json:"uid"`
+	Key     string    `json:"key,omitempty"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Size    uint32    `json:"size"`
+	Date    time.Time `json:"date"`
+}
+
+func newStreamRec(folder, key string, m *imap.Message) streamRec {
+	return streamRec{folder, m.Uid, key, classify(m, "from"), classify(m, "subject"), m.Size, dateOf(m)}
+}
+
+/* ── TLS / connect helpers ─────────────────────────────── */
+
+// implicitTLS holds the TLS mode of servers guessServer found, which may
+// listen on other ports than 993 (TLS) and 143 (STARTTLS).
+var implicitTLS = map[string]bool{}
+
+func dialSmart(addr string) (*client.Client, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	mod := &tls.Config{ServerName: host, InsecureSkipVerify: *insecureF, MinVersion: tls.VersionTLS12}
+	leg := &tls.Config{ServerName: host, InsecureSkipVerify: *insecureF, MinVersion: tls.VersionTLS10,
+		CipherSuites: []uint16{
+			tls.TLS_RSA_WITH_RC4_128_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA}}
+	mod.Certificates, leg.Certificates = clientCerts, clientCerts // -tls-client-cert
+	implicit, known := implicitTLS[addr]
+	if !known {
+		switch port {
+		case "993":
+			implicit, known = true, true
+		case "143":
+			implicit, known = false, true
+		}
+	}
+	connect := func(c *tls.Config) (*client.Client, error) {
+		switch {
+		case !known:
+			return nil, fmt.Errorf("unsupported port")
+		case implicit:
+			return client.DialTLS(addr, c)
+		default:
+			cl, err := client.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			if err = cl.StartTLS(c); err != nil {
+				cl.Logout()
+				return nil, err
+			}
+			return cl, nil
+		}
+	}
+	c, err := connect(mod)
+	if err == nil {
+		note("✅  Modern TLS")
+		return c, nil
+	}
+	var cv *tls.CertificateVerificationError
+	if errors.As(err, &cv) { // legacy TLS would present the same certificate
+		return nil, fmt.Errorf("%s: certificate not trusted: %v (use -insecure for self-signed servers)", host, cv.Err)
+	}
+	if c, err := connect(leg); err == nil {
+		note("⚠️  Legacy TLS")
+		return c, nil
+	}
+	if known && !implicit && *allowPlnF {
+		note("⚠️  Plain IMAP")
+		return client.Dial(addr)
+	}
+	return nil, fmt.Errorf("TLS failed")
+}
+
+/* ── interrupts (Ctrl+C) ─────────────────────────────── */
+
+var (
+	stopping int32 // set once SIGINT/SIGTERM arrived
+
+	liveMu sync.Mutex
+	live   []*client.Client // every connection connect made
+)
+
+func interrupted() bool { return atomic.LoadInt32(&stopping) == 1 }
+
+// watchSignals logs out of every open connection on the first SIGINT or
+// SIGTERM, which also fails whatever FETCH or STORE was in flight so the
+// running operation unwinds (a backup closes its archive as a valid gzip).
+// main then exits with 130; a second signal, or 15s, exits at once.
+func watchSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		atomic.StoreInt32(&stopping, 1)
+		fmt.Fprintln(os.Stderr, "\n⏹  interrupted: logging out…")
+		liveMu.Lock()
+		for _, c := range live {
+			quickLogout(c)
+		}
+		liveMu.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(15 * time.Second):
+		}
+		os.Exit(130)
+	}()
+}
+
+// quickLogout sends LOGOUT, and drops the connection if the server does
+// not answer within a few seconds (e.g. busy with a huge FETCH).
+func quickLogout(c *client.Client) {
+	done := make(chan struct{})
+	go func() {
+		c.Logout()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		c.Terminate()
+	}
+}
+
+// exitIfInterrupted ends the run with 130 once the interrupted operation
+// has returned.
+func exitIfInterrupted() {
+	if interrupted() {
+		os.Exit(130)
+	}
+}
+
+/* ── reconnect (-max-retries) ────────────────────────── */
+
+// isNetErr tells a dropped or broken connection apart from a server that
+// merely refused a command; only the former is worth a reconnect.
+func isNetErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, client.ErrNotLoggedIn) {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection closed", "connection reset", "broken pipe", "closed network connection"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withReconnect runs op for folder and, while it fails with a network
+// error, waits 2s, 4s, 8s… and dials host again, up to -max-retries times.
+// *cli is replaced by the new connection; op re-selects the folder itself.
+func withReconnect(cli **client.Client, host, folder string, op func(c *client.Client) error) error {
+	for attempt := 1; ; attempt++ {
+		err := op(*cli)
+		if !isNetErr(err) || attempt > *maxRetryF || interrupted() {
+			return err
+		}
+		wait := time.Second << attempt
+		note("🔁 %s: %v; reconnecting in %s (attempt %d/%d)", folder, err, wait, attempt, *maxRetryF)
+		time.Sleep(wait)
+		(*cli).Terminate()
+		c, cerr := connect(host)
+		if cerr != nil {
+			note("🔁 %s: reconnect failed: %v", folder, cerr)
+			continue // op fails at once on the dead client and counts as the next attempt
+		}
+		*cli = c
+	}
+}
+
+/* ── command timeouts ─────────────────────────────────── */
+
+// withTimeout runs fn with the per-command deadline set to d (0 = none).
+func withTimeout(cli *client.Client, d time.Duration, fn func() error) error {
+	old := cli.Timeout
+	cli.Timeout = d
+	defer func() { cli.Timeout = old }()
+	return fn()
+}
+
+// search runs UID SEARCH under -search-timeout rather than -timeout: a
+// body search on a huge folder is legitimately slow. Everything from here
+// to wipe works on UIDs, which stay put while sequence numbers shift.
+func search(cli *client.Client, crit *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	err := withTimeout(cli, *searchToF, func() (err error) {
+		ids, err = cli.UidSearch(crit)
+		return
+	})
+	return ids, err
+}
+
+// autoScanBatch is the -scan-batch default: few servers mind a FETCH of
+// this many UIDs, and fewer round-trips than that rarely pay off.
+const autoScanBatch = 5000
+
+// fetchBulk is UID FETCH without a deadline, for whole-folder transfers,
+// split into -scan-batch UIDs per command. It closes ch like UidFetch.
+func fetchBulk(cli *client.Client, uids *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	n := *scanBatchF
+	if n <= 0 {
+		n = autoScanBatch
+	}
+	chunks := splitSet(uids, n)
+	if len(chunks) <= 1 {
+		return withTimeout(cli, 0, func() error { return cli.UidFetch(uids, items, ch) })
+	}
+	defer close(ch)
+	for _, c := range chunks {
+		part := make(chan *imap.Message, cap(ch))
+		done := make(chan error, 1)
+		go func() { done <- withTimeout(cli, 0, func() error { return cli.UidFetch(c, items, part) }) }()
+		for m := range part {
+			ch <- m
+		}
+		if err := <-done; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSet cuts set into sets of at most n numbers; a set ending in "*"
+// can't be counted and is returned whole.
+func splitSet(set *imap.SeqSet, n int) []*imap.SeqSet {
+	var out []*imap.SeqSet
+	cur, cnt := new(imap.SeqSet), 0
+	for _, r := range set.Set {
+		if r.Start == 0 || r.Stop == 0 {
+			return []*imap.SeqSet{set}
+		}
+		for r.Start <= r.Stop {
+			take := uint32(n - cnt)
+			if rest := r.Stop - r.Start + 1; rest < take {
+				take = rest
+			}
+			cur.AddRange(r.Start, r.Start+take-1)
+			cnt += int(take)
+			r.Start += take
+			if cnt == n {
+				out = append(out, cur)
+				cur, cnt = new(imap.SeqSet), 0
+			}
+			if r.Start == 0 { // wrapped past 4294967295
+				break
+			}
+		}
+	}
+	if cnt > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// connect dials host and logs in with -email / -password.
+func connect(host string) (*client.Client, error) {
+	cli, err := dialSmart(host)
+	if err != nil {
+		return nil, err
+	}
+	cli.Timeout = *timeoutF
+	if *oauthF != "" {
+		if ok, _ := cli.SupportAuth("XOAUTH2"); !ok {
+			cli.Logout()
+			return nil, fmt.Errorf("login: %s does not offer AUTH=XOAUTH2; use an app password with -password instead", host)
+		}
+		if err := cli.Authenticate(&xoauth2{*emailF, *oauthF}); err != nil {
+			cli.Logout()
+			return nil, fmt.Errorf("login: XOAUTH2: %w", err)
+		}
+	} else {
+		pw := *passF
+		if pw == "" && *passCmdF != "" {
+			if pw, err = passwordCommand(); err != nil {
+				cli.Logout()
+				return nil, err
+			}
+		}
+		if err := cli.Login(*emailF, pw); err != nil {
+			cli.Logout()
+			return nil, fmt.Errorf("login: %w", err)
+		}
+	}
+	if *sendIDF {
+		if err := sendID(cli); err != nil {
+			log.Println("ID:", err)
+		}
+	}
+	return registered(cli), nil
+}
+
+// registered adds a logged-in cli to the connections watchSignals closes.
+func registered(cli *client.Client) *client.Client {
+	liveMu.Lock()
+	live = append(live, cli)
+	liveMu.Unlock()
+	return cli
+}
+
+// xoauth2 is the SASL XOAUTH2 mechanism of Gmail and Office365 (go-sasl
+// only has the standard OAUTHBEARER).
+type xoauth2 struct {
+	user, token string
+}
+
+func (x *xoauth2) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + x.user + "\x01auth=Bearer " + x.token + "\x01\x01"), nil
+}
+
+// Next answers the server's JSON error challenge with an empty line, after
+// which it fails the command with the actual reason.
+func (x *xoauth2) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// sendID identifies the client with the RFC 2971 ID command.
+func sendID(cli *client.Client) error {
+	if ok, _ := cli.Support("ID"); !ok {
+		return fmt.Errorf("server does not advertise ID")
+	}
+	st, err := cli.Execute(&rawCmd{"ID", []interface{}{
+		[]interface{}{"name", *idNameF, "version", version},
+	}}, nil)
+	if err != nil {
+		return err
+	}
+	return st.Err()
+}
+
+/* ── provider profiles ──────────────────────────────────── */
+
+type provider struct {
+	Name     string
+	Host     string // host:port
+	Auth     string // recommended login method
+	MaxConns int    // server-side concurrent connection limit
+	NeedsID  bool   // rejects commands until the client sends ID
+	Note     string
+}
+
+// providers maps well-known mail domains to their IMAP settings.
+var providers = func() map[string]*provider {
+	gmail := &provider{Name: "Gmail", Host: "imap.gmail.com:993", Auth: "XOAUTH2 or app password", MaxConns: 15,
+		Note: "deleting from a label keeps the mail in [Gmail]/All Mail"}
+	outlook := &provider{Name: "Outlook/Office365", Host: "outlook.office365.com:993", Auth: "XOAUTH2", MaxConns: 8}
+	yahoo := &provider{Name: "Yahoo", Host: "imap.mail.yahoo.com:993", Auth: "app password", MaxConns: 5, NeedsID: true}
+	icloud := &provider{Name: "iCloud", Host: "imap.mail.me.com:993", Auth: "app-specific password", MaxConns: 4}
+	fastmail := &provider{Name: "Fastmail", Host: "imap.fastmail.com:993", Auth: "app password", MaxConns: 10}
+	yandex := &provider{Name: "Yandex", Host: "imap.yandex.com:993", Auth: "app password", MaxConns: 5}
+	gmx := &provider{Name: "GMX", Host: "imap.gmx.net:993", Auth: "password (enable IMAP in settings)", MaxConns: 4}
+	netease := func(d string) *provider {
+		return &provider{Name: "NetEase " + d, Host: "imap." + d + ":993", Auth: "client authorization code", MaxConns: 4, NeedsID: true}
+	}
+	return map[string]*provider{
+		"gmail.com": gmail, "googlemail.com": gmail,
+		"outlook.com": outlook, "hotmail.com": outlook, "live.com": outlook, "msn.com": outlook,
+		"yahoo.com": yahoo, "ymail.com": yahoo,
+		"icloud.com": icloud, "me.com": icloud, "mac.com": icloud,
+		"fastmail.com": fastmail, "fastmail.fm": fastmail,
+		"yandex.ru": yandex, "yandex.com": yandex, "ya.ru": yandex,
+		"gmx.net": gmx, "gmx.de": gmx, "gmx.com": gmx,
+		"163.com": netease("163.com"), "126.com": netease("126.com"), "yeah.net": netease("yeah.net"),
+	}
+}()
+
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return strings.ToLower(email[i+1:])
+	}
+	return ""
+}
+
+// profileFor returns the built-in profile for email's domain, if any.
+func profileFor(email string) *provider {
+	return providers[emailDomain(email)]
+}
+
+// guessCandidates lists the hosts guessServer probes, in order; the last
+// one is the STARTTLS fallback that is used without probing.
+func guessCandidates(email string) []string {
+	d := emailDomain(email)
+	var out []string
+	for _, p := range []string{"imap.", "mail.", ""} {
+		out = append(out, p+d+":993")
+	}
+	return append(out, d+":143")
+}
+
+// lookupSRV is net.LookupSRV; the tests swap in a fake resolver.
+var lookupSRV = net.LookupSRV
+
+// guessServer finds the IMAP server for email: the domain's SRV records
+// (RFC 6186, implicit TLS first), then its autoconfig file, then probing
+// guessCandidates. implicit tells dialSmart whether to speak TLS at once
+// or to use STARTTLS.
+func guessServer(email string) (addr string, implicit bool) {
+	d := emailDomain(email)
+	for _, srv := range []struct {
+		service  string
+		implicit bool
+	}{{"imaps", true}, {"imap", false}} {
+		_, recs, err := lookupSRV(srv.service, "tcp", d)
+		if err != nil {
+			continue
+		}
+		for _, r := range recs { // sorted by priority and weight
+			if r.Target == "." || r.Port == 0 { // "." = service not offered
+				continue
+			}
+			addr = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+			note("🔎 SRV _%s._tcp.%s → %s", srv.service, d, addr)
+			return addr, srv.implicit
+		}
+	}
+	if addr, implicit, err := autoconfig(email); err == nil {
+		note("🔎 autoconfig.%s → %s", d, addr)
+		return addr, implicit
+	}
+	c := guessCandidates(email)
+	for _, h := range c[:len(c)-1] {
+		if c, err := tls.Dial("tcp", h, &tls.Config{InsecureSkipVerify: *insecureF}); err == nil {
+			c.Close()
+			return h, true
+		}
+	}
+	return c[len(c)-1], false
+}
+
+// autoconfig reads the IMAP server from the domain's Thunderbird-style
+// https://autoconfig.<domain>/mail/config-v1.1.xml, if it publishes one.
+func autoconfig(email string) (addr string, implicit bool, err error) {
+	d := emailDomain(email)
+	hc := &http.Client{Timeout: 10 * time.Second}
+	resp, err := hc.Get("https://autoconfig." + d + "/mail/config-v1.1.xml?emailaddress=" + url.QueryEscape(email))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("autoconfig: %s", resp.Status)
+	}
+	var cfg struct {
+		Servers []struct {
+			Type   string `xml:"type,attr"`
+			Host   string `xml:"hostname"`
+			Port   int    `xml:"port"`
+			Socket string `xml:"socketType"`
+		} `xml:"emailProvider>incomingServer"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&cfg); err != nil {
+		return "", false, fmt.Errorf("autoconfig: %w", err)
+	}
+	for _, s := range cfg.Servers {
+		if s.Type != "imap" || s.Host == "" || s.Port == 0 {
+			continue
+		}
+		switch strings.ToUpper(s.Socket) {
+		case "SSL", "STARTTLS":
+		default:
+			continue // never guess our way into plain IMAP
+		}
+		host := strings.NewReplacer("%EMAILDOMAIN%", d, "%EMAILADDRESS%", email).Replace(s.Host)
+		return net.JoinHostPort(host, strconv.Itoa(s.Port)), strings.EqualFold(s.Socket, "SSL"), nil
+	}
+	return "", false, fmt.Errorf("autoconfig: no IMAP server listed")
+}
+
+/* ── raw commands / quota ─────────────────────────────── */
+
+// rawCmd sends a command go-imap has no helper for.
+type rawCmd struct {
+	name string
+	args []interface{}
+}
+
+func (c *rawCmd) Command() *imap.Command {
+	return &imap.Command{Name: c.name, Arguments: c.args}
+}
+
+type quotaRes struct {
+	Root, Name   string
+	Usage, Limit uint32
+}
+
+// getQuota runs GETQUOTAROOT on INBOX and collects every QUOTA reply (RFC 2087).
+func getQuota(cli *client.Client) ([]quotaRes, error) {
+	var out []quotaRes
+	h := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok {
+			return responses.ErrUnhandled
+		}
+		switch name {
+		case "QUOTAROOT":
+			return nil
+		case "QUOTA":
+		default:
+			return responses.ErrUnhandled
+		}
+		if len(fields) < 2 {
+			return nil
+		}
+		root, _ := imap.ParseString(fields[0])
+		lst, _ := fields[1].([]interface{})
+		for i := 0; i+2 < len(lst); i += 3 {
+			n, _ := imap.ParseString(lst[i])
+			u, _ := imap.ParseNumber(lst[i+1])
+			l, _ := imap.ParseNumber(lst[i+2])
+			out = append(out, quotaRes{Root: root, Name: strings.ToUpper(n), Usage: u, Limit: l})
+		}
+		return nil
+	})
+	st, err := cli.Execute(&rawCmd{"GETQUOTAROOT", []interface{}{"INBOX"}}, h)
+	if err != nil {
+		return nil, err
+	}
+	return out, st.Err()
+}
+
+// showQuota prints the server quota, if there is one, and a read-only
+// table of every folder's message count and size.
+func showQuota(cli *client.Client) (acctSum, error) {
+	if ok, _ := cli.Support("QUOTA"); !ok {
+		fmt.Println("Server does not advertise QUOTA: no server-side quota available")
+	} else if err := printQuota(cli); err != nil {
+		log.Println("quota:", err)
+	}
+	recs, sum, err := folderRecs(cli)
+	if err != nil {
+		return sum, err
+	}
+	fmt.Printf("\n%-35s %8s %10s\n", "Folder", "msgs", "MB")
+	for _, r := range recs {
+		fmt.Printf("%-35s %8d %10.1f\n", r.Folder, r.Msgs, float64(r.Bytes)/(1024*1024))
+	}
+	fmt.Printf("Total: %d folders, %d msgs  %.1f MB\n", len(recs), sum.Msgs, float64(sum.Bytes)/(1024*1024))
+	return sum, nil
+}
+
+func printQuota(cli *client.Client) error {
+	qs, err := getQuota(cli)
+	if err != nil {
+		return err
+	}
+	if len(qs) == 0 {
+		fmt.Println("No quota roots reported")
+		return nil
+	}
+	for _, q := range qs {
+		pct := 0.0
+		if q.Limit > 0 {
+			pct = float64(q.Usage) * 100 / float64(q.Limit)
+		}
+		if q.Name == "STORAGE" { // units of 1024 octets
+			fmt.Printf("📊 %q %s: %.2f / %.2f GB (%.0f%%)\n", q.Root, q.Name,
+				float64(q.Usage)/(1024*1024), float64(q.Limit)/(1024*1024), pct)
+		} else {
+			fmt.Printf("📊 %q %s: %d / %d (%.0f%%)\n", q.Root, q.Name, q.Usage, q.Limit, pct)
+		}
+	}
+	return nil
+}
+
+/* ── backup & restore ─────────────────────────────────── */
+
+func selectable(mb *imap.MailboxInfo) bool {
+	for _, a := range mb.Attributes {
+		if a == imap.NoSelectAttr {
+			return false
+		}
+	}
+	return true
+}
+
+// folderWanted reports whether -folders selects name. Patterns use "/"
+// between levels whatever the server's delimiter is, so "Work/*" matches
+// "Work.Clients" on a "." server; the raw name is accepted as well.
+func folderWanted(name, delim string) bool {
+	if len(folderPats) == 0 {
+		return true
+	}
+	if *delimF != "" {
+		delim = *delimF
+	}
+	slashed := name
+	if delim != "" && delim != "/" {
+		slashed = strings.ReplaceAll(name, delim, "/")
+	}
+	for _, p := range folderPats {
+		if strings.EqualFold(p, "INBOX") && strings.EqualFold(name, "INBOX") {
+			return true
+		}
+		if ok, _ := path.Match(p, slashed); ok || p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listFolders returns every selectable mailbox -folders allows, in LIST order.
+func listFolders(cli *client.Client) ([]string, error) {
+	var out []string
+	mbc := make(chan *imap.MailboxInfo, 64)
+	done := make(chan error, 1)
+	go func() { done <- cli.List("", "*", mbc) }()
+	for mb := range mbc {
+		if selectable(mb) && folderWanted(mb.Name, mb.Delimiter) {
+			out = append(out, mb.Name)
+		}
+	}
+	return out, <-done
+}
+
+// entryItems is what an archived message is fetched with. BODY.PEEK[]
+// rather than RFC822, which would set \Seen before the flags are recorded.
+var entryItems = []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, (&imap.BodySectionName{Peek: true}).FetchItem()}
+
+// flagsPAX is the PAX record holding an entry's IMAP flags.
+const flagsPAX = "IMAPTOOL.flags"
+
+// delimPAX holds the hierarchy delimiter of the server an entry was
+// backed up from ("NIL" for a flat one). Entries that carry it name their
+// folder with "/" between levels and each level escaped by archiveSeg;
+// older entries hold the raw mailbox name.
+const delimPAX = "IMAPTOOL.delim"
+
+// validityPAX holds the UIDVALIDITY of the folder an entry was backed up
+// from; an incremental backup trusts the archived UIDs only while it holds.
+const validityPAX = "IMAPTOOL.uidvalidity"
+
+// archiveSeg escapes "%" and "/" in one folder level, so a delimiter-free
+// "/" in a mailbox name survives as part of its level.
+var archiveSeg = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// entryName is folder/uid.eml with folder's levels (split at the server
+// delimiter) joined by "/".
+func entryName(folder, delim string, uid uint32) string {
+	segs := []string{folder}
+	if delim != "" {
+		segs = strings.Split(folder, delim)
+	}
+	for i, sg := range segs {
+		segs[i] = archiveSeg.Replace(sg)
+	}
+	return fmt.Sprintf("%s/%d.eml", strings.Join(segs, "/"), uid)
+}
+
+// entryHeader is the tar header of an archived message: entryName,
+// INTERNALDATE as the mtime and the flags, delimiter and UIDVALIDITY in
+// PAX records.
+func entryHeader(folder, delim string, uidValidity uint32, m *imap.Message, data []byte) *tar.Header {
+	h := &tar.Header{Name: entryName(folder, delim, m.Uid), Size: int64(len(data)), Mode: 0600, ModTime: m.InternalDate}
+	h.PAXRecords = map[string]string{delimPAX: delim}
+	if delim == "" {
+		h.PAXRecords[delimPAX] = "NIL"
+	}
+	if uidValidity != 0 {
+		h.PAXRecords[validityPAX] = strconv.FormatUint(uint64(uidValidity), 10)
+	}
+	if len(m.Flags) > 0 {
+		h.PAXRecords[flagsPAX] = strings.Join(m.Flags, " ")
+	}
+	return h
+}
+
+// entryFolder returns the levels of an archived message's folder. Old
+// entries are split at "/" as before, which is right for archives of
+// "/" servers.
+func entryFolder(h *tar.Header) []string {
+	dir := path.Dir(h.Name)
+	if dir == "." {
+		return []string{"INBOX"}
+	}
+	segs := strings.Split(dir, "/")
+	if _, ok := h.PAXRecords[delimPAX]; ok {
+		for i, sg := range segs {
+			if u, err := url.PathUnescape(sg); err == nil {
+				segs[i] = u
+			}
+		}
+	}
+	return segs
+}
+
+// entryMeta reads back what entryHeader stored. \Recent is dropped since
+// only the server may set it; archives from older versions carry neither
+// flags nor a date, so those restore unread and dated now.
+func entryMeta(h *tar.Header) ([]string, time.Time) {
+	var flags []string
+	for _, fl := range strings.Fields(h.PAXRecords[flagsPAX]) {
+		if !strings.EqualFold(fl, imap.RecentFlag) {
+			flags = append(flags, fl)
+		}
+	}
+	if h.ModTime.Unix() > 0 {
+		return flags, h.ModTime
+	}
+	return flags, time.Now()
+}
+
+// backupFolder writes every message of folder not already in have (an
+// existing archive) or done (an attempt before a reconnect) into tw and
+// reports each entry to tick; returns msgs written. An archived entry
+// only counts while the folder's UIDVALIDITY is the one it was taken
+// under (0: an older archive that didn't record it).
+func backupFolder(cli *client.Client, folder string, tw *tar.Writer, have map[string]uint32, done map[string]bool, tick func(name string, data []byte)) (int64, error) {
+	mb, err := cli.Select(folder, false)
+	if err != nil {
+		return 0, err
+	}
+	delim := serverDelim(cli)
+	held := func(name string) bool {
+		v, ok := have[name]
+		return ok && (v == 0 || v == mb.UidValidity)
+	}
+	crit := imap.NewSearchCriteria()
+	if !*bkInclDelF { // mail already marked for removal stays out
+		crit.WithoutFlags = []string{imap.DeletedFlag}
+		dc := imap.NewSearchCriteria()
+		dc.WithFlags = []string{imap.DeletedFlag}
+		if del, err := search(cli, dc); err == nil {
+			atomic.AddInt64(&bkDeleted, int64(len(del)))
+		}
+	}
+	uids, err := search(cli, crit)
+	if err != nil {
+		return 0, err
+	}
+	if have != nil || done != nil {
+		reset := false
+		for _, u := range uids {
+			if v := have[entryName(folder, delim, u)]; v != 0 && v != mb.UidValidity {
+				reset = true
+				break
+			}
+		}
+		if reset {
+			note("♻️  %s: UIDVALIDITY is now %d; archived UIDs no longer count", folder, mb.UidValidity)
+		}
+		kept := uids[:0]
+		for _, u := range uids {
+			name := entryName(folder, delim, u)
+			if held(name) || held(fmt.Sprintf("%s/%d.eml", folder, u)) { // or as an older version named it
+				atomic.AddInt64(&bkSkipped, 1)
+				continue
+			}
+			if !done[name] {
+				kept = append(kept, u)
+			}
+		}
+		uids = kept
+	}
+	if bkMaxSize > 0 {
+		uids = dropLarge(cli, folder, uids)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	msgCh := make(chan *imap.Message, 32)
+	fetched := make(chan error, 1)
+	go func() { fetched <- fetchBulk(cli, seq, entryItems, msgCh) }()
+	var n int64
+	for m := range msgCh {
+		if m == nil {
+			continue
+		}
+		data, _ := io.ReadAll(m.GetBody(&imap.BodySectionName{}))
+		h := entryHeader(folder, delim, mb.UidValidity, m, data)
+		tw.WriteHeader(h)
+		tw.Write(data)
+		n++
+		tick(h.Name, data)
+	}
+	return n, <-fetched
+}
+
+// backupRetry runs backupFolder under withReconnect; messages written
+// before a dropped connection are not fetched again.
+func backupRetry(cli **client.Client, host, folder string, tw *tar.Writer, have map[string]uint32, tick func(name string, data []byte)) (int64, error) {
+	done := map[string]bool{}
+	var total int64
+	err := withReconnect(cli, host, folder, func(c *client.Client) error {
+		n, err := backupFolder(c, folder, tw, have, done, func(name string, data []byte) {
+			done[name] = true
+			tick(name, data)
+		})
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// bkDeleted counts \Deleted messages backupFolder left out; bkSkipped
+// those an incremental backup already had.
+var bkDeleted, bkSkipped int64
+
+// largeMsg is a message -backup-skip-larger left out of the archive.
+type largeMsg struct {
+	Folder, From, Subject string
+	UID, Size             uint32
+}
+
+var (
+	bkLargeMu sync.Mutex
+	bkLarge   []largeMsg
+)
+
+// dropLarge removes messages over -backup-skip-larger from uids of the
+// selected folder, recording each in bkLarge. Sizes come from one
+// RFC822.SIZE pass; only the oversized ones get an ENVELOPE fetch.
+func dropLarge(cli *client.Client, folder string, uids []uint32) []uint32 {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	big := new(imap.SeqSet)
+	mc := make(chan *imap.Message, 32)
+	go func() { _ = fetchBulk(cli, seq, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, mc) }()
+	for m := range mc {
+		if int64(m.Size) > bkMaxSize {
+			big.AddNum(m.Uid)
+		}
+	}
+	if big.Empty() {
+		return uids
+	}
+	skip := map[uint32]bool{}
+	mc = make(chan *imap.Message, 32)
+	go func() {
+		_ = cli.UidFetch(big, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchEnvelope}, mc)
+	}()
+	for m := range mc {
+		skip[m.Uid] = true
+		note("⏭  %s/%d.eml: %.1f MB, not archived", folder, m.Uid, float64(m.Size)/(1024*1024))
+		bkLargeMu.Lock()
+		bkLarge = append(bkLarge, largeMsg{folder, classify(m, "from"), classify(m, "subject"), m.Uid, m.Size})
+		bkLargeMu.Unlock()
+	}
+	kept := uids[:0]
+	for _, u := range uids {
+		if !skip[u] {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// writeLarge lists the skipped messages in tgz.skipped.tsv next to the
+// archive, so what the backup lacks is on record.
+func writeLarge(tgz string) {
+	if len(bkLarge) == 0 || tgz == "-" { // a piped backup: dropLarge listed them
+		return
+	}
+	path := tgz + ".skipped.tsv"
+	f, err := os.Create(path)
+	if err != nil {
+		log.Println("backup-skip-larger:", err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "folder\tuid\tsize\tfrom\tsubject")
+	for _, m := range bkLarge {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", m.Folder, m.UID, m.Size, m.From, m.Subject)
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("backup-skip-larger:", err)
+		return
+	}
+	fmt.Printf("⏭  left out %d msgs over %s, listed in %s\n", len(bkLarge), *bkMaxF, path)
+}
+
+// carryOver copies every entry of an existing archive into tw (and the
+// index) and returns their names with the UIDVALIDITY each was taken
+// under. Entries taken under an older UIDVALIDITY of a folder in valid
+// (archive folder path → current UIDVALIDITY) are dropped: the folder is
+// fetched again in full and restore would get both copies. A truncated
+// archive, e.g. from a killed run, is copied up to the damage and the
+// rest is fetched again.
+func carryOver(tgz string, tw *tar.Writer, idx *json.Encoder, valid map[string]uint32) (map[string]uint32, error) {
+	f, err := os.Open(tgz)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tgz, err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	have := map[string]uint32{}
+	stale := map[string]int{} // archive folder → entries dropped
+	defer func() {
+		dirs := make([]string, 0, len(stale))
+		for d := range stale {
+			dirs = append(dirs, d)
+		}
+		sort.Strings(dirs)
+		for _, d := range dirs {
+			note("♻️  %s: UIDVALIDITY is now %d; dropped %d msgs archived under the old one", d, valid[d], stale[d])
+		}
+	}()
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return have, nil
+		}
+		if err != nil {
+			fmt.Printf("⚠️  %s truncated after %d msgs: %v\n", tgz, len(have), err)
+			return have, nil
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			fmt.Printf("⚠️  %s truncated in %s: %v\n", tgz, h.Name, err)
+			return have, nil
+		}
+		v, _ := strconv.ParseUint(h.PAXRecords[validityPAX], 10, 32)
+		if cur := valid[path.Dir(h.Name)]; v != 0 && cur != 0 && uint32(v) != cur {
+			stale[path.Dir(h.Name)]++
+			continue
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+		if idx != nil && !h.FileInfo().IsDir() {
+			idx.Encode(indexEntry(h.Name, data))
+		}
+		have[h.Name] = uint32(v)
+	}
+}
+
+// flushEvery is how many messages backupAll writes between flushes.
+const flushEvery = 200
+
+func backupAll(cli *client.Client, host, tgz string) (err error) {
+	atomic.StoreInt64(&bkDeleted, 0)
+	atomic.StoreInt64(&bkSkipped, 0)
+	bkLarge = nil
+	orig := cli
+	defer func() {
+		if cli != orig { // a reconnect replaced the caller's connection
+			cli.Logout()
+		}
+	}()
+	var have map[string]uint32
+	var folders, msgs int64
+	var failed []string // "folder: error" for each one left out
+	defer func() {
+		writeLarge(tgz)
+		if len(failed) > 0 && err == nil { // runs after the .part rename
+			sort.Strings(failed) // -backup-parallel finishes them in any order
+			fmt.Printf("\n❌ %d folders not archived:\n", len(failed))
+			for _, f := range failed {
+				fmt.Printf("   %s\n", f)
+			}
+			err = fmt.Errorf("backup incomplete: %d folders not archived", len(failed))
+		}
+		if interrupted() && err == nil { // runs after the .part rename
+			fmt.Printf("\n⚠️  %s has only %d new msgs; rerun -backup to complete it\n", tgz, msgs)
+			err = fmt.Errorf("backup interrupted")
+		}
+		if n := atomic.LoadInt64(&bkDeleted); n > 0 {
+			fmt.Printf("🗑  left out %d msgs already flagged \\Deleted\n", n)
+		}
+		if have != nil {
+			fmt.Printf("📦 skipped %d already archived, added %d\n", atomic.LoadInt64(&bkSkipped), msgs)
+		}
+	}()
+
+	// an existing archive is carried over into tgz.part and only messages
+	// it lacks are fetched; the finished .part then replaces it, so an
+	// interrupted run leaves the old archive as it was
+	out := tgz
+	if _, e := os.Stat(tgz); e == nil && tgz != "-" {
+		out = tgz + ".part"
+		defer func() {
+			if err != nil {
+				os.Remove(out)
+			} else {
+				err = os.Rename(out, tgz)
+			}
+		}()
+	}
+	var w io.Writer = uidOut // "-backup -": the real stdout, see main
+	if tgz != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	gw := gzip.NewWriter(w)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	names, err := listFolders(cli)
+	if err != nil {
+		return err
+	}
+
+	var idx *json.Encoder
+	if *indexF != "" {
+		xf, err := os.Create(*indexF)
+		if err != nil {
+			return err
+		}
+		defer xf.Close()
+		idx = json.NewEncoder(xf)
+	}
+
+	// STATUS counts up front give the progress line its ETA, and the
+	// UIDVALIDITYs tell carryOver which archived folders were reset
+	var total int64
+	delim := serverDelim(cli)
+	valid := map[string]uint32{}
+	for _, n := range names {
+		if st, err := cli.Status(n, []imap.StatusItem{imap.StatusMessages, imap.StatusUidValidity}); err == nil {
+			total += int64(st.Messages)
+			valid[path.Dir(entryName(n, delim, 0))] = st.UidValidity
+		}
+	}
+
+	if out != tgz {
+		if have, err = carryOver(tgz, tw, idx, valid); err != nil {
+			return err
+		}
+		note("📦 %s already holds %d msgs; fetching only new ones", tgz, len(have))
+	}
+	bkStart := time.Now()
+	var mu sync.Mutex
+	tick := func(name string, data []byte) {
+		mu.Lock()
+		if idx != nil {
+			idx.Encode(indexEntry(name, data))
+		}
+		msgs++
+		progress("📦 Backup folders:%d msgs:%d%s", folders, msgs,
+			rate(bkStart, msgs, total-atomic.LoadInt64(&bkSkipped)-atomic.LoadInt64(&bkDeleted)))
+		mu.Unlock()
+	}
+
+	// flush at entry boundaries so a killed run leaves a readable archive
+	// up to the last flush
+	flush := func() {
+		tw.Flush()
+		gw.Flush()
+	}
+
+	if *backupParF <= 1 {
+		for _, name := range names {
+			if interrupted() {
+				break
+			}
+			n, err := backupRetry(&cli, host, name, tw, have, func(name string, data []byte) {
+				tick(name, data)
+				if msgs%flushEvery == 0 {
+					flush()
+				}
+			})
+			if err != nil && !interrupted() {
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			}
+			if n > 0 {
+				folders++
+				flush()
+			}
+		}
+		progressDone()
+		return nil
+	}
+
+	// parallel: each folder goes to its own temp tar, merged in LIST order
+	// afterwards so the archive content is the same for any N.
+	tmp, err := os.MkdirTemp("", "imap-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	conns := []*client.Client{cli}
+	for len(conns) < *backupParF {
+		c, err := connect(host)
+		if err != nil {
+			for _, c := range conns[1:] {
+				c.Logout()
+			}
+			return err
+		}
+		conns = append(conns, c)
+	}
+	defer func() {
+		for _, c := range conns[1:] {
+			c.Logout()
+		}
+	}()
+
+	parts := make([]string, len(names))
+	jobs := make(chan int)
+	var firstErr error
+	var wg sync.WaitGroup
+	for k := range conns {
+		wg.Add(1)
+		go func(c **client.Client) {
+			defer wg.Done()
+			for i := range jobs {
+				pf, err := os.Create(filepath.Join(tmp, strconv.Itoa(i)+".tar"))
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				ptw := tar.NewWriter(pf)
+				n, err := backupRetry(c, host, names[i], ptw, have, tick)
+				ptw.Close()
+				pf.Close()
+				mu.Lock()
+				if err != nil && !interrupted() {
+					failed = append(failed, fmt.Sprintf("%s: %v", names[i], err))
+				}
+				if n > 0 {
+					folders++
+					parts[i] = pf.Name()
+				}
+				mu.Unlock()
+			}
+		}(&conns[k])
+	}
+	for i := range names {
+		if interrupted() {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	cli = conns[0]
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		pf, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(pf)
+		for {
+			h, e := tr.Next()
+			if e != nil {
+				break
+			}
+			tw.WriteHeader(h)
+			io.Copy(tw, tr)
+		}
+		pf.Close()
+		flush()
+	}
+	progressDone()
+	return nil
+}
+
+// appendRetry appends one message, retrying with exponential backoff.
+func appendRetry(cli *client.Client, fold string, m appendMsg) ([]uint32, error) {
+	var err error
+	var uids []uint32
+	wait := time.Second
+	for try := 0; try <= *restRetryF; try++ {
+		if try > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if uids, err = multiAppend(cli, fold, []appendMsg{m}); err == nil {
+			return uids, nil
+		}
+	}
+	return nil, err
+}
+
+// uidMapFile writes -restore-uid-map rows: archive entry, old UID,
+// destination folder, new UID. A nil *uidMapFile ignores add.
+type uidMapFile struct {
+	f *os.File
+	w *csv.Writer
+	n int
+}
+
+func newUIDMap(path string) (*uidMapFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	um := &uidMapFile{f: f, w: csv.NewWriter(f)}
+	um.w.Write([]string{"entry", "old_uid", "folder", "new_uid"})
+	return um, nil
+}
+
+// add records msgs appended to fold; uids are their APPENDUID values in
+// order (missing when the server didn't send them).
+func (um *uidMapFile) add(fold string, msgs []appendMsg, uids []uint32) {
+	if um == nil {
+		return
+	}
+	for i, m := range msgs {
+		if i >= len(uids) {
+			break
+		}
+		old := strings.TrimSuffix(path.Base(m.Name), ".eml")
+		um.w.Write([]string{m.Name, old, fold, strconv.FormatUint(uint64(uids[i]), 10)})
+		um.n++
+	}
+}
+
+func (um *uidMapFile) close() error {
+	if um == nil {
+		return nil
+	}
+	um.w.Flush()
+	err := um.w.Error()
+	if e := um.f.Close(); err == nil {
+		err = e
+	}
+	fmt.Printf("📝 %d UID mappings → %s\n", um.n, um.f.Name())
+	return err
+}
+
+type appendMsg struct {
+	Name  string
+	Flags []string
+	Date  time.Time
+	Data  []byte
+}
+
+// multiAppend stores msgs in fold with one APPEND (MULTIAPPEND when
+// there are several) and returns the new UIDs from a UIDPLUS APPENDUID
+// reply, if the server sent one. It is a raw command because
+// client.Append drops the response code.
+func multiAppend(cli *client.Client, fold string, msgs []appendMsg) ([]uint32, error) {
+	mbox, _ := utf7.Encoding.NewEncoder().String(fold)
+	args := []interface{}{imap.FormatMailboxName(mbox)}
+	for _, m := range msgs {
+		if len(m.Flags) > 0 {
+			fl := make([]interface{}, len(m.Flags))
+			for i, f := range m.Flags {
+				fl[i] = imap.RawString(f)
+			}
+			args = append(args, fl)
+		}
+		args = append(args, m.Date, bytes.NewBuffer(m.Data))
+	}
+	st, err := cli.Execute(&rawCmd{"APPEND", args}, nil)
+	if err == nil {
+		err = st.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appendUIDs(st), nil
+}
+
+// appendUIDs parses "[APPENDUID uidvalidity uid-set]" (RFC 4315).
+func appendUIDs(st *imap.StatusResp) []uint32 {
+	if st.Code != "APPENDUID" || len(st.Arguments) < 2 {
+		return nil
+	}
+	set, err := imap.ParseSeqSet(fmt.Sprint(st.Arguments[1]))
+	if err != nil {
+		return nil
+	}
+	var out []uint32
+	for _, r := range set.Set {
+		for u := r.Start; u <= r.Stop && r.Stop != 0; u++ {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+/* ── archive index (-index / -grep-archive) ───────────── */
+
+type indexRec struct {
+	Folder  string    `json:"folder"`
+	UID     uint32    `json:"uid"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+	Size    int       `json:"size"`
+	Path    string    `json:"path"` // entry name inside the .tgz
+}
+
+// indexEntry describes one archived message from its tar name and bytes.
+func indexEntry(name string, data []byte) indexRec {
+	r := indexRec{Folder: path.Dir(name), Size: len(data), Path: name}
+	if u, err := strconv.ParseUint(strings.TrimSuffix(path.Base(name), ".eml"), 10, 32); err == nil {
+		r.UID = uint32(u)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return r
+	}
+	dec := &mime.WordDecoder{CharsetReader: imap.CharsetReader}
+	get := func(k string) string {
+		v := msg.Header.Get(k)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			return d
+		}
+		return v
+	}
+	r.From, r.To, r.Subject = get("From"), get("To"), get("Subject")
+	r.Date, _ = msg.Header.Date()
+	return r
+}
+
+// grepArchive prints index entries whose from/to/subject contain term.
+func grepArchive(path, term string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var n int
+	for {
+		var r indexRec
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if containsFold(r.From+"\x00"+r.To+"\x00"+r.Subject, term) {
+			fmt.Printf("%s  %s  %-30s %s\n", r.Path, r.Date.Format("2006-01-02"), trim(r.From), trim(r.Subject))
+			n++
+		}
+	}
+	fmt.Printf("%d matches\n", n)
+	return nil
+}
+
+type destMsg struct {
+	UID, Size uint32
+}
+
+var msgIDSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"MESSAGE-ID"}},
+	Peek:         true,
+}
+
+// destIndex maps Message-ID to the messages already in fold.
+func destIndex(cli *client.Client, fold string) map[string][]destMsg {
+	idx := map[string][]destMsg{}
+	if _, err := cli.Select(fold, false); err != nil {
+		return idx
+	}
+	seq := new(imap.SeqSet)
+	seq.AddRange(1, 0)
+	mc := make(chan *imap.Message, 64)
+	go func() { _ = fetchBulk(cli, seq, []imap.FetchItem{imap.FetchRFC822Size, msgIDSection.FetchItem()}, mc) }()
+	for m := range mc {
+		if h := msgHeader(m, msgIDSection); h != nil && h.Get("Message-Id") != "" {
+			id := h.Get("Message-Id")
+			idx[id] = append(idx[id], destMsg{m.Uid, m.Size})
+		}
+	}
+	return idx
+}
+
+// collide applies -restore-collision to an archive entry whose Message-ID
+// is already in fold and reports whether it should still be appended. An
+// identical copy (same bytes; only copies of the same size are fetched to
+// compare) is always skipped; for a differing one skip
+// drops the entry, keep-both appends it and replace deletes the old copy
+// first (after flushing pending Appends).
+func collide(cli *client.Client, fold, name string, data []byte, idx map[string][]destMsg, flush func()) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return true
+	}
+	id := msg.Header.Get("Message-Id")
+	have := idx[id]
+	if id == "" || len(have) == 0 {
+		return true
+	}
+	for _, d := range have {
+		if int(d.Size) == len(data) && sameBody(cli, fold, d.UID, data) {
+			progressDone()
+			fmt.Printf("  = identical  %s\n", name)
+			return false
+		}
+	}
+	switch *collF {
+	case "keep-both":
+		progressDone()
+		fmt.Printf("  + keep both  %s %s\n", name, id)
+		return true
+	case "replace":
+		flush()
+		ss := new(imap.SeqSet)
+		for _, d := range have {
+			ss.AddNum(d.UID)
+		}
+		_, err := cli.Select(fold, false)
+		if err == nil {
+			var old []uint32
+			for _, d := range have {
+				old = append(old, d.UID)
+			}
+			warnForeignDeleted(cli, fold, old)
+			err = cli.UidStore(ss, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+		}
+		if err == nil {
+			err = expungeUIDs(cli, ss)
+		}
+		if err != nil {
+			progressDone()
+			fmt.Printf("  ! replace    %s: %v - keeping both\n", name, err)
+		} else {
+			progressDone()
+			fmt.Printf("  ~ replace    %s %s\n", name, id)
+			delete(idx, id)
+		}
+		return true
+	}
+	progressDone()
+	fmt.Printf("  - skip       %s %s\n", name, id)
+	return false
+}
+
+// sameBody reports whether message uid of fold is byte for byte data.
+func sameBody(cli *client.Client, fold string, uid uint32, data []byte) bool {
+	if mb := cli.Mailbox(); mb == nil || mb.Name != fold {
+		if _, err := cli.Select(fold, false); err != nil {
+			return false
+		}
+	}
+	ss := new(imap.SeqSet)
+	ss.AddNum(uid)
+	sec := &imap.BodySectionName{Peek: true}
+	mc := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() { done <- cli.UidFetch(ss, []imap.FetchItem{sec.FetchItem()}, mc) }()
+	var body []byte
+	for m := range mc {
+		if r := m.GetBody(&imap.BodySectionName{}); r != nil {
+			body, _ = io.ReadAll(r)
+		}
+	}
+	return <-done == nil && bytes.Equal(body, data)
+}
+
+// maildirEntry maps a maildir tar entry ("Sent/cur/1700000000.M1P2.host:2,S"
+// or Maildir++ ".Sent/new/…") to its folder and delivery time: the Unix
+// timestamp that leads the file name, else the entry's mtime.
+func maildirEntry(h *tar.Header) (string, time.Time) {
+	dir, base := path.Split(h.Name)
+	dir = strings.TrimSuffix(dir, "/")
+	switch path.Base(dir) {
+	case "cur", "new", "tmp":
+		dir = path.Dir(dir)
+	}
+	dir = strings.TrimPrefix(strings.TrimPrefix(dir, "Maildir"), "/")
+	dir = strings.TrimPrefix(dir, ".")
+	if dir == "" {
+		dir = "INBOX"
+	}
+	ts := base
+	if i := strings.IndexFunc(base, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		ts = base[:i]
+	}
+	if sec, err := strconv.ParseInt(ts, 10, 64); err == nil && sec > 0 {
+		return dir, time.Unix(sec, 0)
+	}
+	if h.ModTime.Unix() > 0 {
+		return dir, h.ModTime
+	}
+	return dir, time.Now()
+}
+
+// serverDelim asks the server for its hierarchy delimiter ("" if flat);
+// -delimiter overrides the answer for servers that misreport it.
+func serverDelim(cli *client.Client) string {
+	if *delimF != "" {
+		return *delimF
+	}
+	ch := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() { done <- cli.List("", "", ch) }()
+	var delim string
+	for mb := range ch {
+		delim = mb.Delimiter
+	}
+	<-done
+	return delim
+}
+
+// archiveFolder is one folder of a native archive: its directory inside
+// the tar and its levels (entryFolder).
+type archiveFolder struct {
+	Dir  string
+	Segs []string
+}
+
+// archiveFolders lists the distinct folders of a native archive in order.
+func archiveFolders(tgz string) ([]archiveFolder, error) {
+	f, err := os.Open(tgz)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	seen := map[string]bool{}
+	var out []archiveFolder
+	for {
+		h, err := tr.Next()
+		if err != nil { // EOF, or a truncation restoreAll reports itself
+			return out, nil
+		}
+		if dir := path.Dir(h.Name); !h.FileInfo().IsDir() && !seen[dir] {
+			seen[dir] = true
+			out = append(out, archiveFolder{dir, entryFolder(h)})
+		}
+	}
+}
+
+// checkDelim finds archive folders with a level that contains the
+// destination's hierarchy delimiter, which would silently split it into
+// subfolders. It lists them and asks to sanitize (delimiter → "_") or
+// abort; the returned map gives the sanitized levels per archive dir.
+func checkDelim(cli *client.Client, tgz string) (map[string][]string, error) {
+	delim := serverDelim(cli)
+	if delim == "" {
+		return nil, nil
+	}
+	folders, err := archiveFolders(tgz)
+	if err != nil {
+		return nil, err
+	}
+	rename := map[string][]string{}
+	for _, af := range folders {
+		if fixed, changed := sanitizeSegs(af.Segs, delim); changed {
+			rename[af.Dir] = fixed
+		}
+	}
+	if len(rename) == 0 {
+		return nil, nil
+	}
+	fmt.Printf("⚠️  %d archive folders contain the server's delimiter %q and would become subfolders:\n", len(rename), delim)
+	for _, af := range folders {
+		if r, ok := rename[af.Dir]; ok {
+			fmt.Printf("  %-35s → %s\n", strings.Join(af.Segs, delim), strings.Join(r, delim))
+		}
+	}
+	fmt.Print("s=sanitize as shown  a=abort (s/A): ")
+	var ans string
+	fmt.Scanln(&ans)
+	if strings.ToLower(ans) != "s" {
+		return nil, fmt.Errorf("restore aborted: folder names clash with delimiter %q", delim)
+	}
+	return rename, nil
+}
+
+// sanitizeSegs replaces delim inside folder levels by "_".
+func sanitizeSegs(segs []string, delim string) ([]string, bool) {
+	fixed := make([]string, len(segs))
+	changed := false
+	for i, sg := range segs {
+		if fixed[i] = strings.ReplaceAll(sg, delim, "_"); fixed[i] != sg {
+			changed = true
+		}
+	}
+	return fixed, changed
+}
+
+func restoreAll(cli *client.Client, tgz string) error {
+	var r io.Reader = os.Stdin // "-restore -"
+	if tgz != "-" {
+		f, err := os.Open(tgz)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	// go-imap sends non-synchronizing literals on its own once the server
+	// advertises LITERAL+ or LITERAL-, but only for literals of 4096 bytes
+	// or less; a larger Append still waits for the continuation.
+	for _, c := range []string{"LITERAL+", "LITERAL-"} {
+		if ok, _ := cli.Support(c); ok {
+			note("⚡ %s: msgs up to 4 KB are appended without waiting for the server", c)
+			break
+		}
+	}
+
+	var rename map[string][]string
+	delim := "/" // what joins the archive's folder levels on the server
+	if *restSrcF == "native" {
+		if tgz != "-" { // a piped archive can't be read twice; see the loop
+			if rename, err = checkDelim(cli, tgz); err != nil {
+				return err
+			}
+		}
+		if d := serverDelim(cli); d != "" {
+			delim = d
+		}
+	}
+
+	// MULTIAPPEND (RFC 3502) sends -restore-batch messages of one folder
+	// per APPEND; a rejected batch is retried one message at a time
+	batchN := 1
+	if ok, _ := cli.Support("MULTIAPPEND"); ok && *restBatchF > 1 {
+		batchN = *restBatchF
+		note("⚡ MULTIAPPEND on (batch %d)", batchN)
+	}
+
+	var uidMap *uidMapFile
+	if *uidMapF != "" {
+		if ok, _ := cli.Support("UIDPLUS"); !ok {
+			fmt.Println("⚠️  server lacks UIDPLUS: -restore-uid-map will stay empty")
+		}
+		if uidMap, err = newUIDMap(*uidMapF); err != nil {
+			return err
+		}
+		defer func() {
+			if err := uidMap.close(); err != nil {
+				log.Println("restore-uid-map:", err)
+			}
+		}()
+	}
+
+	var restored, skipped int64
+	var failed []string
+	created := map[string]bool{}
+	dest := map[string]map[string][]destMsg{} // -restore-collision lookups
+	var batch []appendMsg
+	var batchFold string
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		sent := false
+		if len(batch) > 1 {
+			if uids, err := multiAppend(cli, batchFold, batch); err == nil {
+				sent = true
+				restored += int64(len(batch))
+				uidMap.add(batchFold, batch, uids)
+			}
+		}
+		if !sent {
+			for _, m := range batch {
+				if uids, err := appendRetry(cli, batchFold, m); err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %v", m.Name, err))
+				} else {
+					restored++
+					uidMap.add(batchFold, []appendMsg{m}, uids)
+				}
+			}
+		}
+		batch = batch[:0]
+		progress("⬆️ Restore msgs:%d", restored)
+		if *restDelayF > 0 {
+			time.Sleep(*restDelayF)
+		}
+	}
+	start := time.Now()
+	for !interrupted() {
+		h, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil { // e.g. an interrupted backup: keep what was flushed
+			fmt.Printf("\n⚠️  archive truncated after %d msgs: %v\n", restored, e)
+			break
+		}
+		if h.FileInfo().IsDir() {
+			continue
+		}
+		segs := entryFolder(h)
+		flags, date := entryMeta(h)
+		if *restSrcF == "maildir" {
+			var fold string
+			fold, date = maildirEntry(h)
+			segs = []string{fold}
+		}
+		// -restore-folder names a folder with "/" or the server's delimiter
+		if len(*restFoldF) > 0 && !restFoldF.has(strings.Join(segs, "/")) && !restFoldF.has(strings.Join(segs, delim)) {
+			skipped++
+			continue
+		}
+		if r, ok := rename[path.Dir(h.Name)]; ok && *restSrcF == "native" {
+			segs = r
+		} else if tgz == "-" && *restSrcF == "native" {
+			if fixed, changed := sanitizeSegs(segs, delim); changed {
+				if !created[strings.Join(fixed, delim)] {
+					fmt.Printf("⚠️  %q contains the server's delimiter %q: restored as %s\n", strings.Join(segs, "/"), delim, strings.Join(fixed, delim))
+				}
+				segs = fixed
+			}
+		}
+		fold := strings.Join(segs, delim)
+		if fold != batchFold || len(batch) >= batchN {
+			flush()
+			batchFold = fold
+		}
+		if !created[fold] {
+			cli.Create(fold)
+			created[fold] = true
+		}
+		data, e := io.ReadAll(tr)
+		if e != nil {
+			fmt.Printf("\n⚠️  archive truncated in %s: %v\n", h.Name, e)
+			break
+		}
+		if *collF != "" {
+			if dest[fold] == nil {
+				dest[fold] = destIndex(cli, fold)
+			}
+			if !collide(cli, fold, h.Name, data, dest[fold], flush) {
+				skipped++
+				continue
+			}
+		}
+		batch = append(batch, appendMsg{h.Name, flags, date, data})
+	}
+	flush()
+	progressDone()
+	if el := time.Since(start).Seconds(); restored > 0 && el > 0 {
+		fmt.Printf("⬆️ %d msgs in %.0fs (%.1f msg/s)\n", restored, el, float64(restored)/el)
+	}
+	if skipped > 0 {
+		fmt.Printf("⏭  skipped %d entries (-restore-folder / -restore-collision), restored %d\n", skipped, restored)
+	}
+	if len(failed) > 0 {
+		fmt.Printf("⚠️  %d msgs failed:\n", len(failed))
+		for _, f := range failed {
+			fmt.Println("  ", f)
+		}
+	}
+	return nil
+}
+
+/* ── folder scan ──────────────────────────────────────── */
+
+// scanFolder selects folder, runs the -match SEARCH (or ALL in stats mode)
+// and calls fn for every fetched message whose UID is not in skip. A failed
+// SELECT returns the error before anything is searched, so results never
+// come from a stale selection; network errors of SEARCH and FETCH are
+// returned too, for withReconnect.
+func scanFolder(cli *client.Client, folder string, statsMode, sizeOn bool, skip map[uint32]bool, fn func(*imap.Message)) error {
+	if _, err := cli.Select(folder, false); err != nil {
+		return err
+	}
+	crit := baseCriteria()
+	if !statsMode && *matchF != "" && !*fuzzyF && matchRe == nil && !hasField("auth-result") { // the server can't do -fuzzy, -regex or verdicts
+		if flds := strings.Split(*fieldF, ","); len(flds) == 1 {
+			crit.Header.Add(strings.Title(*fieldF), *matchF)
+		} else if len(subjTerms) == 0 { // -subject-any takes the OR below
+			crit.Or = orFields(flds, *matchF).Or
+		}
+	}
+	if !statsMode && len(subjTerms) > 0 {
+		crit.Or = orHeader("Subject", subjTerms).Or
+	}
+	uids, err := search(cli, crit)
+	if len(uids) == 0 && statsMode && !isNetErr(err) {
+		crit = baseCriteria()
+		uids, err = search(cli, crit)
+	}
+	if isNetErr(err) {
+		return err
+	}
+	// -limit: the newest N by UID, before skip so a retry keeps the sample
+	if n := *limitF; n > 0 && len(uids) > n {
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		note("🎲 %s: sampled %d of %d", folder, n, len(uids))
+		uids = uids[len(uids)-n:]
+	}
+	if len(skip) > 0 {
+		kept := uids[:0]
+		for _, u := range uids {
+			if !skip[u] {
+				kept = append(kept, u)
+			}
+		}
+		uids = kept
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	// plain header fields are lighter than ENVELOPE on many servers, so
+	// pickHeaders times both once unless -fast forces them; classify
+	// parses them when Envelope is nil
+	items := []imap.FetchItem{imap.FetchEnvelope}
+	hdrs := *fastF
+	if statsMode && (*fieldF == "folder" || *fieldF == "size") {
+		// the bucket is the folder itself, or RFC822.SIZE alone decides it
+		items, hdrs = []imap.FetchItem{imap.FetchUid}, false
+	} else {
+		if !hdrs {
+			hdrs = pickHeaders(cli, uids)
+		}
+		if hdrs {
+			items = []imap.FetchItem{hdrSection.FetchItem()}
+		}
+	}
+	if (*exclSelfF || *streamF) && statsMode && (*fieldF == "folder" || *fieldF == "size") {
+		items = append(items, imap.FetchEnvelope) // fromSelf and -stream-json need the sender
+	}
+	if sizeOn {
+		items = append(items, imap.FetchRFC822Size)
+	}
+	if *hdrFbF && !hdrs {
+		items = append(items, hdrSection.FetchItem())
+	}
+	if *matchHdrF != "" {
+		items = append(items, customSection().FetchItem())
+	}
+	if hasField("auth-result") || !statsMode && *matchAuthF != "" {
+		items = append(items, authSection.FetchItem())
+	}
+	if !statsMode && *matchRcvF != "" {
+		items = append(items, rcvSection.FetchItem())
+	}
+	if !statsMode && *unsubF {
+		items = append(items, unsubSection.FetchItem())
+	}
+	if !statsMode && *attTypeF != "" {
+		items = append(items, imap.FetchBodyStructure)
+	}
+	mc := make(chan *imap.Message, 32)
+	done := make(chan error, 1)
+	go func() { done <- fetchBulk(cli, seq, items, mc) }()
+	for m := range mc {
+		atomic.AddInt64(&runMetrics.scanned, 1)
+		fn(m)
+	}
+	if err := <-done; isNetErr(err) {
+		return err
+	}
+	return nil
+}
+
+// probeMsgs is how many messages pickHeaders fetches each way.
+const probeMsgs = 50
+
+// scanPick is what pickHeaders measured; done stays false until a folder
+// big enough for the probe comes along.
+var scanPick struct {
+	sync.Mutex
+	done, headers bool
+}
+
+// pickHeaders fetches the last probeMsgs of uids in the selected folder
+// once with ENVELOPE and once with hdrSection, the first time a folder
+// has that many, and reports for the rest of the run whether header
+// fields were the faster of the two.
+func pickHeaders(cli *client.Client, uids []uint32) bool {
+	scanPick.Lock()
+	defer scanPick.Unlock()
+	if scanPick.done || len(uids) < probeMsgs {
+		return scanPick.headers
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids[len(uids)-probeMsgs:]...)
+	timed := func(item imap.FetchItem) (time.Duration, error) {
+		start := time.Now()
+		mc := make(chan *imap.Message, probeMsgs)
+		done := make(chan error, 1)
+		go func() {
+			done <- withTimeout(cli, 0, func() error { return cli.UidFetch(seq, []imap.FetchItem{imap.FetchUid, item}, mc) })
+		}()
+		for range mc {
+		}
+		return time.Since(start), <-done
+	}
+	env, err := timed(imap.FetchEnvelope)
+	if err != nil {
+		return false // a later folder tries again
+	}
+	hdr, err := timed(hdrSection.FetchItem())
+	if err != nil {
+		return false
+	}
+	scanPick.done, scanPick.headers = true, hdr < env
+	use := "ENVELOPE"
+	if scanPick.headers {
+		use = "header fields"
+	}
+	note("⚡ %d msgs: ENVELOPE %v, header fields %v; scanning with %s (-fast forces header fields)",
+		probeMsgs, env.Round(time.Millisecond), hdr.Round(time.Millisecond), use)
+	return scanPick.headers
+}
+
+// baseCriteria is the scan SEARCH before any -match terms: the date window
+// and, unless -include-deleted, NOT DELETED.
+func baseCriteria() *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.Since, c.Before = winSince, winBefore
+	if !*inclDelF { // count live mail, not what awaits EXPUNGE
+		c.WithoutFlags = []string{imap.DeletedFlag}
+	}
+	return c
+}
+
+// parseBetween reads "2023-01-01:2023-06-30" into SINCE / BEFORE bounds;
+// the end day is inclusive, so BEFORE is the day after it.
+func parseBetween(s string) (since, before time.Time, err error) {
+	a, b, ok := strings.Cut(s, ":")
+	if !ok {
+		return since, before, fmt.Errorf("-between wants START:END, got %q", s)
+	}
+	if since, err = time.Parse("2006-01-02", strings.TrimSpace(a)); err != nil {
+		return
+	}
+	end, err := time.Parse("2006-01-02", strings.TrimSpace(b))
+	if err != nil {
+		return
+	}
+	if !since.Before(end) {
+		return since, before, fmt.Errorf("-between: start %s is not before end %s", a, b)
+	}
+	return since, end.AddDate(0, 0, 1), nil
+}
+
+// orHeader builds "OR (HEADER key t1) (OR (HEADER key t2) ...)" as one
+// criteria; a single term is a plain HEADER search.
+func orHeader(key string, terms []string) *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.Header.Add(key, terms[0])
+	if len(terms) == 1 {
+		return c
+	}
+	out := imap.NewSearchCriteria()
+	out.Or = [][2]*imap.SearchCriteria{{c, orHeader(key, terms[1:])}}
+	return out
+}
+
+// orFields is HEADER k term for any of keys, as nested ORs.
+func orFields(keys []string, term string) *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.Header.Add(strings.Title(keys[0]), term)
+	if len(keys) == 1 {
+		return c
+	}
+	out := imap.NewSearchCriteria()
+	out.Or = [][2]*imap.SearchCriteria{{c, orFields(keys[1:], term)}}
+	return out
+}
+
+// containsFold is a case-insensitive substring test on NFC-normalized
+// text, so "é" typed one way matches "é" encoded the other way.
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(norm.NFC.String(s)), strings.ToLower(norm.NFC.String(sub)))
+}
+
+// isSentFolder recognises the Sent folder by its \Sent special-use
+// attribute, or by the usual names on servers without SPECIAL-USE.
+func isSentFolder(mb *imap.MailboxInfo) bool {
+	for _, a := range mb.Attributes {
+		if a == imap.SentAttr {
+			return true
+		}
+	}
+	switch strings.ToLower(mb.Name) {
+	case "sent", "sent items", "sent messages", "inbox.sent", "[gmail]/sent mail":
+		return true
+	}
+	return false
+}
+
+// fromSelf reports whether m was sent by the logged-in -email.
+func fromSelf(m *imap.Message) bool {
+	return strings.EqualFold(classify(m, "from"), *emailF)
+}
+
+// fuzzyContains reports whether some substring of s is within k edits
+// (Levenshtein) of sub, case-insensitively: "biqcorp" finds "bigcorp".
+func fuzzyContains(s, sub string, k int) bool {
+	a := []rune(strings.ToLower(norm.NFC.String(s)))
+	b := []rune(strings.ToLower(norm.NFC.String(sub)))
+	// prev[j]: edits to match b[:j] ending at the current position of a;
+	// a match may start anywhere, so row 0 stays 0 and the best over all
+	// end positions is prev[len(b)]
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	best := prev[len(b)]
+	for i := 1; i <= len(a); i++ {
+		cur[0] = 0
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j-1]+cost, prev[j]+1, cur[j-1]+1)
+		}
+		best = min(best, cur[len(b)])
+		prev, cur = cur, prev
+	}
+	return best <= k
+}
+
+// matchField compares -match with each -field of m; any hit counts.
+func matchField(m *imap.Message) bool {
+	for _, v := range classifyEach(m, *fieldF) {
+		switch {
+		case *fuzzyF:
+			if fuzzyContains(v, *matchF, *fuzzyDistF) {
+				return true
+			}
+		case matchRe != nil:
+			if matchRe.MatchString(v) {
+				return true
+			}
+		default:
+			if containsFold(v, *matchF) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isMatch applies the client-side -match / -subject-any filters to m.
+func isMatch(m *imap.Message) bool {
+	if *matchF != "" && !matchField(m) {
+		return false
+	}
+	if *attTypeF != "" && !hasPartType(m.BodyStructure, *attTypeF) {
+		return false
+	}
+	if *matchRcvF != "" && !receivedMatch(m) {
+		return false
+	}
+	if *matchAuthF != "" && authResult(m) != *matchAuthF {
+		return false
+	}
+	return len(subjTerms) == 0 || len(subjectHits(m)) > 0
+}
+
+var rcvSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"RECEIVED"}},
+	Peek:         true,
+}
+
+var authSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"AUTHENTICATION-RESULTS"}},
+	Peek:         true,
+}
+
+// authResult reduces the topmost Authentication-Results header (the one
+// the receiving server added; lower ones may be forged or forwarded) to
+// "pass" when DKIM or SPF passed, "fail" when either produced any other
+// verdict, and "none" when neither was checked.
+func authResult(m *imap.Message) string {
+	h := msgHeader(m, authSection)
+	if h == nil || len(h["Authentication-Results"]) == 0 {
+		return "none"
+	}
+	verdict := "none"
+	for _, part := range strings.FieldsFunc(h["Authentication-Results"][0], func(r rune) bool { return r == ';' || r == ' ' || r == '\t' }) {
+		method, res, ok := strings.Cut(strings.ToLower(part), "=")
+		if !ok || method != "dkim" && method != "spf" {
+			continue
+		}
+		switch res {
+		case "pass":
+			return "pass"
+		case "none":
+		default:
+			verdict = "fail"
+		}
+	}
+	return verdict
+}
+
+// matchRe is -match compiled under -regex.
+var matchRe *regexp.Regexp
+
+// rcvRe is -match-received compiled when given as /regex/.
+var rcvRe *regexp.Regexp
+
+// receivedMatch checks -match-received against every Received: header.
+func receivedMatch(m *imap.Message) bool {
+	h := msgHeader(m, rcvSection)
+	for _, v := range h["Received"] {
+		if rcvRe != nil && rcvRe.MatchString(v) ||
+			rcvRe == nil && containsFold(v, *matchRcvF) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPartType reports whether any MIME part of bs is of type mt
+// ("application/pdf", or "image/*" for a whole top-level type).
+func hasPartType(bs *imap.BodyStructure, mt string) bool {
+	if bs == nil {
+		return false
+	}
+	mt = strings.ToLower(mt)
+	got := strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType)
+	if got == mt || (strings.HasSuffix(mt, "/*") && strings.HasPrefix(got, mt[:len(mt)-1])) {
+		return true
+	}
+	for _, p := range bs.Parts {
+		if hasPartType(p, mt) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded applies -exclude to a message that already matched.
+func isExcluded(m *imap.Message) bool {
+	return *excludeF != "" &&
+		containsFold(classify(m, excludeField()), *excludeF)
+}
+
+func excludeField() string {
+	if *exclFldF != "" {
+		return *exclFldF
+	}
+	return *fieldF
+}
+
+// subjectHits lists the -subject-any phrases found in m's subject.
+func subjectHits(m *imap.Message) []string {
+	sub := subjectOf(m)
+	var out []string
+	for _, t := range subjTerms {
+		if containsFold(sub, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// matchDesc describes the active match for headings.
+func matchDesc() string {
+	var parts []string
+	if matchRe != nil {
+		parts = append(parts, fmt.Sprintf("/%s/ (%s)", *matchF, *fieldF))
+	} else if *matchF != "" && *fuzzyF {
+		parts = append(parts, fmt.Sprintf("~%d \"%s\" (%s)", *fuzzyDistF, *matchF, *fieldF))
+	} else if *matchF != "" {
+		parts = append(parts, fmt.Sprintf("\"%s\" (%s)", *matchF, *fieldF))
+	}
+	if len(subjTerms) > 0 {
+		parts = append(parts, fmt.Sprintf("subject any of %q", subjTerms))
+	}
+	if *attTypeF != "" {
+		parts = append(parts, "attachment "+*attTypeF)
+	}
+	if *matchAuthF != "" {
+		parts = append(parts, "auth "+*matchAuthF)
+	}
+	if *matchRcvF != "" {
+		parts = append(parts, "received via "+*matchRcvF)
+	}
+	return strings.Join(parts, " and ")
+}
+
+// sampleMatch runs -match against one folder, shows a few hits and asks
+// whether to scan the whole account.
+func sampleMatch(cli *client.Client, folder string, sizeOn bool) bool {
+	var n int
+	var ex []*imap.Message
+	if err := scanFolder(cli, folder, false, sizeOn, nil, func(m *imap.Message) {
+		if isMatch(m) {
+			n++
+			if len(ex) < 5 {
+				ex = append(ex, m)
+			}
+		}
+	}); err != nil {
+		log.Printf("sample %s: %v", folder, err)
+	}
+	fmt.Printf("\nSample %s: %d matches for %s\n", folder, n, matchDesc())
+	for _, m := range ex {
+		fmt.Printf("  %s  %-40s %s\n", dateOf(m).Format("2006-01-02"), trim(classify(m, "from")), trim(subjectOf(m)))
+	}
+	if *yesF {
+		return true
+	}
+	fmt.Print("Scan all folders? (y/N): ")
+	var ans string
+	fmt.Scanln(&ans)
+	return strings.ToLower(ans) == "y"
+}
+
+/* ── stats table ──────────────────────────────────────── */
+
+// renderPage draws rows start..end of list as one boxed table page.
+func renderPage(w io.Writer, title string, list []*bucket, start, end int, sizeOn bool) {
+	fmt.Fprintf(w, "\n%s %d‑%d / %d\n", title, start+1, end, len(list))
+	if sizeOn {
+		fmt.Fprintln(w, "┌────┬──────────────────────────────────────────┬────────┬────────┐")
+		fmt.Fprintf(w, "│  # │ %-40s │  MSGS  │  MB │\n", title)
+		fmt.Fprintln(w, "├────┼──────────────────────────────────────────┼────────┼────────┤")
+	} else {
+		fmt.Fprintln(w, "┌────┬──────────────────────────────────────────┬────────┐")
+		fmt.Fprintf(w, "│  # │ %-40s │  MSGS  │\n", title)
+		fmt.Fprintln(w, "├────┼──────────────────────────────────────────┼────────┤")
+	}
+	for i := start; i < end; i++ {
+		b := list[i]
+		if sizeOn {
+			fmt.Fprintf(w, "│ %2d │ %-40s │ %6d │ %6.1f │\n", i-start+1, trim(b.Key), b.Cnt, float64(b.Bytes)/(1024*1024))
+		} else {
+			fmt.Fprintf(w, "│ %2d │ %-40s │ %6d │\n", i-start+1, trim(b.Key), b.Cnt)
+		}
+	}
+	if sizeOn {
+		fmt.Fprintln(w, "└────┴──────────────────────────────────────────┴────────┴────────┘")
+	} else {
+		fmt.Fprintln(w, "└────┴──────────────────────────────────────────┴────────┘")
+	}
+}
+
+// matchTable pages through the folders of a match like the stats table.
+// A number deletes that folder's matches, a the whole page, g everything.
+func matchTable(cli *client.Client, target *bucket, bytes map[string]int64) {
+	var list []*bucket
+	for f, ids := range target.ByFolder {
+		list = append(list, &bucket{Key: f, Cnt: len(ids), Bytes: bytes[f], ByFolder: map[string][]uint32{f: ids}})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Cnt > list[j].Cnt })
+	page := 0
+	for {
+		start, end := page*pageSz, (page+1)*pageSz
+		if start >= len(list) {
+			fmt.Println("End")
+			return
+		}
+		if end > len(list) {
+			end = len(list)
+		}
+		renderPage(os.Stdout, "FOLDER", list, start, end, true)
+		fmt.Print("num=del folder  a=del page  g=del all  n/p  q : ")
+		var in string
+		fmt.Scanln(&in)
+		var pick []*bucket
+		switch strings.ToLower(in) {
+		case "n":
+			page++
+			continue
+		case "p":
+			if page > 0 {
+				page--
+			}
+			continue
+		case "q":
+			return
+		case "a":
+			pick = list[start:end]
+		case "g":
+			pick = list
+		default:
+			idx, err := strconv.Atoi(in)
+			if err != nil || idx < 1 || idx > end-start {
+				fmt.Println("bad input")
+				continue
+			}
+			pick = list[start+idx-1 : start+idx]
+		}
+		del := map[string][]uint32{}
+		for _, b := range pick {
+			del[b.Key] = b.ByFolder[b.Key]
+		}
+		if !matchDelete(cli, del) || *dryRunF {
+			continue
+		}
+		var rest []*bucket
+		for _, b := range list {
+			if del[b.Key] == nil {
+				rest = append(rest, b)
+			}
+		}
+		list = rest
+		if page*pageSz >= len(list) && page > 0 {
+			page--
+		}
+	}
+}
+
+// matchDelete narrows a match delete set by -keep-latest / -keep-recent,
+// asks, and wipes it; false if nothing was left or the user said no.
+func matchDelete(cli *client.Client, del map[string][]uint32) bool {
+	if n := countSets(del); *keepLatF > 0 {
+		del = keepLatest(cli, del, *keepLatF, true)
+		fmt.Printf("Keep newest %d per sender (%d), %s %d\n", *keepLatF, n-countSets(del), strings.ToLower(action()), countSets(del))
+	}
+	del = keepRecent(cli, del)
+	if countSets(del) == 0 {
+		fmt.Println("nothing to " + strings.ToLower(action()))
+		return false
+	}
+	if *exportF != "" {
+		if err := exportEML(cli, *exportF, del); err != nil {
+			log.Println("export:", err, "- nothing changed")
+			return false
+		}
+	}
+	if *confSumF {
+		blastRadius(cli, del)
+	}
+	if !confirmDelete(fmt.Sprintf("%s %d msgs? (y/N): ", action(), countSets(del))) {
+		return false
+	}
+	wipe(cli, del)
+	return true
+}
+
+// parseRowTemplate compiles -template; \t and \n typed in the shell
+// become real tabs and newlines. {{mb .Bytes}} formats megabytes.
+func parseRowTemplate(src string) (*template.Template, error) {
+	src = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(src)
+	return template.New("row").Funcs(template.FuncMap{
+		"mb": func(b int64) string { return fmt.Sprintf("%.1f", float64(b)/(1024*1024)) },
+	}).Parse(src)
+}
+
+// writeStats saves every page of the sorted table to path (-stats-out).
+func writeStats(path string, groups []statGroup, sizeOn bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Folder != "" {
+			fmt.Fprintf(f, "\n📁 %s\n", g.Folder)
+		}
+		list := g.List
+		for start := 0; start < len(list); start += pageSz {
+			end := start + pageSz
+			if end > len(list) {
+				end = len(list)
+			}
+			renderPage(f, strings.ToUpper(*fieldF), list, start, end, sizeOn)
+		}
+	}
+	return f.Close()
+}
+
+// jsonRow is one -json element; Folder is set under -by-folder.
+type jsonRow struct {
+	Field   string              `json:"field"`
+	Folder  string              `json:"folder,omitempty"`
+	Key     string              `json:"key"`
+	Count   int                 `json:"count"`
+	Bytes   int64               `json:"bytes,omitempty"`
+	Folders map[string][]uint32 `json:"folders,omitempty"` // -json-uids
+}
+
+// writeJSON prints the stats as one JSON array, largest buckets (by
+// -sort) first.
+func writeJSON(w io.Writer, groups []statGroup, sizeOn bool) error {
+	rows := []jsonRow{}
+	for _, g := range groups {
+		for _, b := range g.List {
+			r := jsonRow{Field: *fieldF, Folder: g.Folder, Key: b.Key, Count: b.Cnt}
+			if sizeOn {
+				r.Bytes = b.Bytes
+			}
+			if *jsonUIDsF {
+				r.Folders = b.ByFolder
+			}
+			rows = append(rows, r)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if *sortF == "size" {
+			return rows[i].Bytes > rows[j].Bytes
+		}
+		return rows[i].Count > rows[j].Count
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+// statsTable pages through one stats table with the interactive delete;
+// true means the user quit with q rather than paging past the end.
+func statsTable(cli *client.Client, list []*bucket, sizeOn bool) bool {
+	page := 0
+	for {
+		start, end := page*pageSz, (page+1)*pageSz
+		if start >= len(list) {
+			fmt.Println("End")
+			return false
+		}
+		if end > len(list) {
+			end = len(list)
+		}
+		renderPage(os.Stdout, strings.ToUpper(*fieldF), list, start, end, sizeOn)
+		if *keepLatF > 0 {
+			fmt.Printf("num=trim to %d  a=trim page  n/p  q : ", *keepLatF)
+		} else {
+			fmt.Print("num=del  n/p  q : ")
+		}
+		var in string
+		fmt.Scanln(&in)
+		switch strings.ToLower(in) {
+		case "n":
+			page++
+		case "p":
+			if page > 0 {
+				page--
+			}
+		case "q":
+			return true
+		case "a":
+			if *keepLatF <= 0 {
+				fmt.Println("bad input")
+				continue
+			}
+			all := map[string][]uint32{}
+			var rest []*bucket
+			for i, b := range list {
+				if i < start || i >= end || b.Cnt <= *keepLatF {
+					rest = append(rest, b)
+					continue
+				}
+				del := keepRecent(cli, keepLatest(cli, b.ByFolder, *keepLatF, false))
+				fmt.Printf("  %-40s keep %4d  delete %4d\n", trim(b.Key), b.Cnt-countSets(del), countSets(del))
+				for f, ids := range del {
+					all[f] = append(all[f], ids...)
+				}
+			}
+			if len(all) == 0 {
+				fmt.Println("nothing to trim")
+				continue
+			}
+			if *exportF != "" {
+				if err := exportEML(cli, *exportF, all); err != nil {
+					log.Println("export:", err, "- nothing changed")
+					continue
+				}
+			}
+			if *confSumF {
+				blastRadius(cli, all)
+			}
+			if confirmDelete(fmt.Sprintf("%s %d msgs? (y/N): ", action(), countSets(all))) {
+				wipe(cli, all)
+				if *dryRunF {
+					continue
+				}
+				list = rest
+				if start >= len(list) && page > 0 {
+					page--
+				}
+			}
+		default:
+			idx, err := strconv.Atoi(in)
+			if err != nil || idx < 1 || idx > end-start {
+				fmt.Println("bad input")
+				continue
+			}
+			b := list[start+idx-1]
+			del := b.ByFolder
+			if *keepLatF > 0 {
+				del = keepLatest(cli, del, *keepLatF, false)
+			}
+			del = keepRecent(cli, del)
+			if countSets(del) == 0 {
+				fmt.Println("nothing to " + strings.ToLower(action()))
+				continue
+			}
+			if *exportF != "" {
+				if err := exportEML(cli, *exportF, del); err != nil {
+					log.Println("export:", err, "- nothing changed")
+					continue
+				}
+			}
+			if *confSumF {
+				blastRadius(cli, del)
+			}
+			prompt := fmt.Sprintf("%s ALL for \"%s\" (%d)? (y/N): ", action(), b.Key, b.Cnt)
+			if countSets(del) < b.Cnt {
+				prompt = fmt.Sprintf("Keep newest %d of \"%s\", %s %d? (y/N): ", b.Cnt-countSets(del), b.Key, strings.ToLower(action()), countSets(del))
+			}
+			if confirmDelete(prompt) {
+				wipe(cli, del)
+				if *dryRunF {
+					continue
+				}
+				list = append(list[:start+idx-1], list[start+idx:]...)
+				if start >= len(list) && page > 0 {
+					page--
+				}
+			}
+		}
+	}
+}
+
+// statGroup is one table: all buckets, or under -by-folder one folder's.
+type statGroup struct {
+	Folder string
+	List   []*bucket
+}
+
+// byFolderSep joins folder and key in -by-folder bucket keys.
+const byFolderSep = "\x00"
+
+// splitByFolder turns the folder-prefixed -by-folder buckets of list into
+// one group per folder, in scan order, keeping list's order within each.
+func splitByFolder(list []*bucket, folders []string) []statGroup {
+	per := map[string][]*bucket{}
+	for _, b := range list {
+		folder, key, _ := strings.Cut(b.Key, byFolderSep)
+		b.Key = key
+		per[folder] = append(per[folder], b)
+	}
+	var out []statGroup
+	for _, f := range folders {
+		if len(per[f]) > 0 {
+			out = append(out, statGroup{f, per[f]})
+		}
+	}
+	return out
+}
+
+/* ── folder report (-folder-report) ───────────────────── */
+
+type folderRec struct {
+	Folder string    `json:"folder"`
+	Msgs   uint32    `json:"messages"`
+	Unseen uint32    `json:"unseen"`
+	Bytes  int64     `json:"bytes"`
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+// folderRecs gathers one record per selectable folder: STATUS counts
+// plus a RFC822.SIZE/INTERNALDATE scan.
+func folderRecs(cli *client.Client) ([]folderRec, acctSum, error) {
+	var sum acctSum
+	folders, err := listFolders(cli)
+	if err != nil {
+		return nil, sum, err
+	}
+	var recs []folderRec
+	for i, f := range folders {
+		progress("📊 %2d/%2d folders", i+1, len(folders))
+		r := folderRec{Folder: f}
+		st, err := cli.Status(f, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+		if err != nil {
+			log.Printf("\n⚠️  skip %s: status: %v", f, err)
+			continue
+		}
+		r.Msgs, r.Unseen = st.Messages, st.Unseen
+		if r.Msgs > 0 {
+			if _, err := cli.Select(f, true); err != nil {
+				log.Printf("\n⚠️  skip %s: select: %v", f, err)
+				continue
+			}
+			seq := new(imap.SeqSet)
+			seq.AddRange(1, 0)
+			mc := make(chan *imap.Message, 64)
+			go func() {
+				_ = fetchBulk(cli, seq, []imap.FetchItem{imap.FetchRFC822Size, imap.FetchInternalDate}, mc)
+			}()
+			for m := range mc {
+				r.Bytes += int64(m.Size)
+				if d := m.InternalDate; !d.IsZero() {
+					if r.Oldest.IsZero() || d.Before(r.Oldest) {
+						r.Oldest = d
+					}
+					if d.After(r.Newest) {
+						r.Newest = d
+					}
+				}
+			}
+		}
+		sum.Msgs += int64(r.Msgs)
+		sum.Bytes += r.Bytes
+		recs = append(recs, r)
+	}
+	progressDone()
+	return recs, sum, nil
+}
+
+// folderReport writes the folderRecs to path: CSV for *.csv, else JSON.
+func folderReport(cli *client.Client, path string) (acctSum, error) {
+	at := time.Now().UTC().Truncate(time.Second)
+	recs, sum, err := folderRecs(cli)
+	if err != nil {
+		return sum, err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return sum, err
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		w := csv.NewWriter(out)
+		w.Write([]string{"time", "folder", "messages", "unseen", "bytes", "oldest", "newest"})
+		day := func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.Format("2006-01-02")
+		}
+		for _, r := range recs {
+			w.Write([]string{at.Format(time.RFC3339), r.Folder,
+				strconv.Itoa(int(r.Msgs)), strconv.Itoa(int(r.Unseen)), strconv.FormatInt(r.Bytes, 10),
+				day(r.Oldest), day(r.Newest)})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			Time    time.Time   `json:"time"`
+			Folders []folderRec `json:"folders"`
+		}{at, recs})
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		fmt.Printf("📝 %d folders, %d msgs, %.1f MB → %s\n", len(recs), sum.Msgs, float64(sum.Bytes)/(1024*1024), path)
+	}
+	return sum, err
+}
+
+/* ── age / size specs ─────────────────────────────────── */
+
+// parseAgeSpec turns "2024-01-31", an RFC 3339 time, or a relative age
+// such as "90d" / "12w" / "36h" into an absolute point in time.
+func parseAgeSpec(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if len(s) < 2 {
+		return time.Time{}, fmt.Errorf("bad age %q", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("bad age %q", s)
+	}
+	var d time.Duration
+	switch s[len(s)-1] {
+	case 'h':
+		d = time.Hour
+	case 'd':
+		d = 24 * time.Hour
+	case 'w':
+		d = 7 * 24 * time.Hour
+	default:
+		return time.Time{}, fmt.Errorf("bad age %q (use h, d or w)", s)
+	}
+	return time.Now().Add(-time.Duration(n) * d), nil
+}
+
+// parseSize reads "5MB", "500KB", "1GB" or a plain byte count.
+func parseSize(s string) (int64, error) {
+	u := strings.ToUpper(strings.TrimSpace(s))
+	mul := int64(1)
+	for _, x := range []struct {
+		suf string
+		m   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(u, x.suf) {
+			u, mul = strings.TrimSuffix(u, x.suf), x.m
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(u), 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(f * float64(mul)), nil
+}
+
+/* ── REPL (-repl) ─────────────────────────────────────── */
+
+// replTerm is one "key:value" filter of a REPL expression.
+type replTerm func(m *imap.Message) bool
+
+func parseReplExpr(line string) ([]replTerm, error) {
+	var out []replTerm
+	for _, tok := range strings.Fields(line) {
+		k, v, ok := strings.Cut(tok, ":")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("bad term %q (want key:value)", tok)
+		}
+		switch k = strings.ToLower(k); k {
+		case "from", "to", "subject", "in-reply-to", "message-id":
+			out = append(out, func(m *imap.Message) bool {
+				return containsFold(classify(m, k), v)
+			})
+		case "older", "newer":
+			t, err := parseAgeSpec(v)
+			if err != nil {
+				return nil, err
+			}
+			older := k == "older"
+			out = append(out, func(m *imap.Message) bool {
+				return m.InternalDate.Before(t) == older
+			})
+		case "larger", "smaller":
+			n, err := parseSize(v)
+			if err != nil {
+				return nil, err
+			}
+			larger := k == "larger"
+			out = append(out, func(m *imap.Message) bool {
+				return (int64(m.Size) > n) == larger
+			})
+		default:
+			return nil, fmt.Errorf("unknown key %q", k)
+		}
+	}
+	return out, nil
+}
+
+// replLoad fetches (or re-fetches) the envelopes of the given folders.
+func replLoad(cli *client.Client, cache map[string][]*imap.Message, folders []string) {
+	for i, f := range folders {
+		cache[f] = nil
+		if _, err := cli.Select(f, false); err != nil {
+			continue
+		}
+		ids, _ := search(cli, imap.NewSearchCriteria())
+		if len(ids) > 0 {
+			ss := new(imap.SeqSet)
+			ss.AddNum(ids...)
+			mc := make(chan *imap.Message, 32)
+			go func() {
+				_ = fetchBulk(cli, ss, []imap.FetchItem{imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchInternalDate}, mc)
+			}()
+			for m := range mc {
+				cache[f] = append(cache[f], m)
+			}
+		}
+		progress("⏳ %2d/%2d folders cached", i+1, len(folders))
+	}
+	progressDone()
+}
+
+func repl(cli *client.Client, folders []string) {
+	cache := map[string][]*imap.Message{}
+	replLoad(cli, cache, folders)
+	fmt.Println("terms: from: to: subject: older:90d newer:2w larger:5MB smaller:100KB")
+	fmt.Println("cmds:  <terms> | + <terms> (refine) | show | delete | rescan | quit")
+
+	in := bufio.NewScanner(os.Stdin)
+	var cur []replTerm
+	var curText string
+	hits := map[string][]*imap.Message{}
+	eval := func() {
+		hits = map[string][]*imap.Message{}
+		var n int
+		var sz int64
+		for _, f := range folders {
+			for _, m := range cache[f] {
+				ok := true
+				for _, t := range cur {
+					if !t(m) {
+						ok = false
+						break
+					}
+				}
+				if ok {
+					hits[f] = append(hits[f], m)
+					n++
+					sz += int64(m.Size)
+				}
+			}
+		}
+		for _, f := range folders {
+			if len(hits[f]) > 0 {
+				fmt.Printf("  %-35s %6d\n", f, len(hits[f]))
+			}
+		}
+		fmt.Printf("[%s] %d msgs  %.1f MB\n", curText, n, float64(sz)/(1024*1024))
+	}
+	for {
+		fmt.Print("imap> ")
+		if !in.Scan() {
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		switch {
+		case line == "":
+		case line == "quit" || line == "q":
+			return
+		case line == "rescan":
+			replLoad(cli, cache, folders)
+			eval()
+		case line == "show":
+			shown := 0
+			for _, f := range folders {
+				for _, m := range hits[f] {
+					if shown == pageSz {
+						break
+					}
+					fmt.Printf("  %-20s %s  %-30s %s\n", trim(f), m.InternalDate.Format("2006-01-02"),
+						trim(classify(m, "from")), trim(subjectOf(m)))
+					shown++
+				}
+			}
+		case line == "delete":
+			sets := map[string][]uint32{}
+			var n int
+			for f, ms := range hits {
+				for _, m := range ms {
+					sets[f] = append(sets[f], m.Uid)
+					n++
+				}
+			}
+			if n == 0 {
+				fmt.Println("nothing selected")
+				continue
+			}
+			if !*dryRunF {
+				fmt.Printf("%s %d msgs? (y/N): ", action(), n)
+				if !in.Scan() || strings.ToLower(strings.TrimSpace(in.Text())) != "y" {
+					continue
+				}
+			}
+			wipe(cli, sets)
+			if *dryRunF {
+				continue
+			}
+			var touched []string
+			for f := range sets {
+				touched = append(touched, f)
+			}
+			replLoad(cli, cache, touched) // drop what was just deleted
+			eval()
+		default:
+			refine := strings.HasPrefix(line, "+")
+			terms, err := parseReplExpr(strings.TrimPrefix(line, "+"))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if refine {
+				cur = append(cur, terms...)
+				curText = strings.TrimSpace(curText + " " + strings.TrimSpace(line[1:]))
+			} else {
+				cur, curText = terms, line
+			}
+			eval()
+		}
+	}
+}
+
+/* ── abandoned drafts (-clean-drafts) ─────────────────── */
+
+func cleanDrafts(cli *client.Client, age string) error {
+	before, err := parseAgeSpec(age)
+	if err != nil {
+		return err
+	}
+	folder := findSpecial(cli, imap.DraftsAttr)
+	if folder == "" {
+		folder = "Drafts"
+	}
+	if _, err := cli.Select(folder, false); err != nil {
+		return fmt.Errorf("select %s: %w", folder, err)
+	}
+	crit := imap.NewSearchCriteria()
+	crit.Before = before
+	crit.WithoutFlags = []string{imap.DeletedFlag} // already on their way out
+	ids, err := search(cli, crit)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Printf("No drafts in %s older than %s\n", folder, age)
+		return nil
+	}
+	ss := new(imap.SeqSet)
+	ss.AddNum(ids...)
+	mc := make(chan *imap.Message, 32)
+	go func() { _ = cli.UidFetch(ss, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate}, mc) }()
+	fmt.Printf("\n%s: %d drafts older than %s\n", folder, len(ids), age)
+	for m := range mc {
+		fmt.Printf("  %s  %s\n", m.InternalDate.Format("2006-01-02"), trim(subjectOf(m)))
+	}
+	if confirmDelete(action() + "? (y/N): ") {
+		wipe(cli, map[string][]uint32{folder: ids})
+	}
+	return nil
+}
+
+/* ── duplicates (-dedup) ──────────────────────────────── */
+
+// dedupCopy is one message of a duplicate group; ID is its -dedup-key
+// value and pos its place in keep order.
+type dedupCopy struct {
+	ID     string
+	Folder string
+	UID    uint32
+	Size   uint32
+	Date   time.Time
+	pos    int
+}
+
+// dedupKeys are the -dedup-key strategies, each with what a message
+// lacking the key is said to lack.
+var dedupKeys = map[string]string{
+	"message-id":   "a Message-Id",
+	"subject+date": "a subject",
+	"body-hash":    "a body",
+}
+
+// dedupWindow is how far apart the INTERNALDATEs of two messages with the
+// same subject may be for -dedup-key subject+date to call them copies.
+const dedupWindow = 2 * time.Minute
+
+var dedupText = &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Peek: true}
+
+// dedupItems is what dedup fetches for the chosen key.
+func dedupItems() []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+	switch *dedupKeyF {
+	case "subject+date":
+		return append(items, imap.FetchEnvelope, imap.FetchInternalDate)
+	case "body-hash":
+		return append(items, dedupText.FetchItem())
+	}
+	return append(items, imap.FetchEnvelope)
+}
+
+// dedupKey returns m's -dedup-key value: the Message-Id, the subject
+// lower-cased with its spaces collapsed, or a SHA-256 of the body text;
+// "" when m has none.
+func dedupKey(m *imap.Message) string {
+	switch *dedupKeyF {
+	case "subject+date":
+		return strings.ToLower(strings.Join(strings.Fields(subjectOf(m)), " "))
+	case "body-hash":
+		r := m.GetBody(dedupText)
+		if r == nil {
+			return ""
+		}
+		h := sha256.New()
+		io.Copy(h, r)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	if m.Envelope == nil {
+		return ""
+	}
+	return strings.TrimSpace(m.Envelope.MessageId)
+}
+
+// splitByDate breaks one subject+date group into runs whose INTERNALDATEs
+// lie within dedupWindow of the run's earliest, each in keep order.
+func splitByDate(g []dedupCopy) [][]dedupCopy {
+	byDate := append([]dedupCopy(nil), g...)
+	sort.SliceStable(byDate, func(a, b int) bool { return byDate[a].Date.Before(byDate[b].Date) })
+	var runs [][]dedupCopy
+	for _, c := range byDate {
+		if n := len(runs); n > 0 && c.Date.Sub(runs[n-1][0].Date) <= dedupWindow {
+			runs[n-1] = append(runs[n-1], c)
+			continue
+		}
+		runs = append(runs, []dedupCopy{c})
+	}
+	for _, r := range runs {
+		sort.Slice(r, func(a, b int) bool { return r[a].pos < r[b].pos })
+	}
+	return runs
+}
+
+// dedup groups every message by -dedup-key (Message-Id by default) and
+// offers to delete all but the first copy (LIST order, then lowest UID)
+// of each group. Messages without the key are only counted. On Gmail
+// every label is a view of All Mail, where a \Deleted copy goes to Trash
+// for all labels, so only All Mail itself is searched there.
+func dedup(cli *client.Client) error {
+	folders, err := listFolders(cli)
+	if err != nil {
+		return err
+	}
+	if gmailTrash(cli) != "" {
+		if all := findSpecial(cli, imap.AllAttr); all != "" {
+			note("🏷  Gmail: looking for duplicates in %s only", all)
+			folders = []string{all}
+		}
+	}
+	if *moveF != "" { // copies moved there by an earlier run are not duplicates again
+		kept := folders[:0]
+		for _, f := range folders {
+			if f != *moveF {
+				kept = append(kept, f)
+			}
+		}
+		folders = kept
+	}
+	note("🔑 duplicates by %s", *dedupKeyF)
+	groups := map[string][]dedupCopy{}
+	var order []string // keys in first-seen order
+	noID := map[string]int{}
+	var total, noIDs, pos int
+	for i, f := range folders {
+		if _, err := cli.Select(f, true); err != nil {
+			log.Printf("\n⚠️  skip %s: %v", f, err)
+			continue
+		}
+		ids, err := search(cli, imap.NewSearchCriteria())
+		if err != nil {
+			log.Printf("\n⚠️  skip %s: %v", f, err)
+			continue
+		}
+		if len(ids) > 0 {
+			ss := new(imap.SeqSet)
+			ss.AddNum(ids...)
+			mc := make(chan *imap.Message, 256)
+			done := make(chan error, 1)
+			go func() {
+				done <- fetchBulk(cli, ss, dedupItems(), mc)
+			}()
+			var got []dedupCopy
+			for m := range mc {
+				total++
+				id := dedupKey(m)
+				if id == "" {
+					noID[f]++
+					noIDs++
+					continue
+				}
+				got = append(got, dedupCopy{ID: id, Folder: f, UID: m.Uid, Size: m.Size, Date: m.InternalDate})
+			}
+			if err := <-done; err != nil {
+				log.Printf("\n⚠️  %s: %v", f, err)
+			}
+			// FETCH answers need not come in UID order
+			sort.Slice(got, func(a, b int) bool { return got[a].UID < got[b].UID })
+			for _, c := range got {
+				c.pos = pos
+				pos++
+				if groups[c.ID] == nil {
+					order = append(order, c.ID)
+				}
+				groups[c.ID] = append(groups[c.ID], c)
+			}
+		}
+		progress("⏳ %2d/%2d folders  msgs:%d", i+1, len(folders), total)
+	}
+	progressDone()
+
+	del := map[string][]uint32{}
+	var dupSets int
+	var reclaim int64
+	for _, id := range order {
+		runs := [][]dedupCopy{groups[id]}
+		if *dedupKeyF == "subject+date" {
+			runs = splitByDate(groups[id])
+		}
+		for _, g := range runs {
+			if len(g) < 2 {
+				continue
+			}
+			dupSets++
+			for _, c := range g[1:] { // g[0] is kept
+				del[c.Folder] = append(del[c.Folder], c.UID)
+				reclaim += int64(c.Size)
+			}
+		}
+	}
+	if noIDs > 0 {
+		fmt.Printf("🆔 %d msgs without %s left alone:\n", noIDs, dedupKeys[*dedupKeyF])
+		for _, f := range folders {
+			if noID[f] > 0 {
+				fmt.Printf("  %-35s %6d\n", f, noID[f])
+			}
+		}
+	}
+	if dupSets == 0 {
+		fmt.Printf("No duplicates among %d msgs\n", total)
+		return nil
+	}
+	if *moveF != "" {
+		fmt.Printf("\nDuplicate copies to move to %s (one of each kept)\n", *moveF)
+	} else {
+		fmt.Printf("\nDuplicate copies to remove (one of each kept)\n")
+	}
+	for _, f := range folders {
+		if len(del[f]) > 0 {
+			fmt.Printf("  %-35s %6d\n", f, len(del[f]))
+		}
+	}
+	fmt.Printf("Total: %d duplicate sets, %d extra copies  %.1f MB reclaimable\n",
+		dupSets, countSets(del), float64(reclaim)/(1024*1024))
+	if *confSumF {
+		blastRadius(cli, del)
+	}
+	if confirmDelete(action() + " the extra copies? (y/N): ") {
+		wipe(cli, del)
+	}
+	return nil
+}
+
+/* ── one-click unsubscribe (-unsubscribe) ─────────────── */
+
+var unsubSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier,
+		Fields: []string{"LIST-UNSUBSCRIBE", "LIST-UNSUBSCRIBE-POST"}},
+	Peek: true,
+}
+
+// oneClickURL returns m's RFC 8058 one-click endpoint: an https
+// List-Unsubscribe URI backed by List-Unsubscribe-Post; "" if none.
+func oneClickURL(m *imap.Message) string {
+	h := msgHeader(m, unsubSection)
+	if h == nil || !strings.Contains(strings.ToLower(h.Get("List-Unsubscribe-Post")), "list-unsubscribe=one-click") {
+		return ""
+	}
+	for _, part := range strings.Split(h.Get("List-Unsubscribe"), ",") {
+		u := strings.Trim(strings.TrimSpace(part), "<>")
+		if strings.HasPrefix(strings.ToLower(u), "https://") {
+			return u
+		}
+	}
+	return ""
+}
+
+// unsubscribe offers to POST the one-click request for every sender in
+// urls (sender → endpoint) and reports the outcome per sender.
+func unsubscribe(urls map[string]string) {
+	if len(urls) == 0 {
+		fmt.Println("✉️  no one-click unsubscribe links among the matches")
+		return
+	}
+	senders := make([]string, 0, len(urls))
+	for s := range urls {
+		senders = append(senders, s)
+	}
+	sort.Strings(senders)
+	fmt.Printf("\nOne-click unsubscribe available for %d senders:\n", len(senders))
+	for _, s := range senders {
+		fmt.Printf("  %s\n", s)
+	}
+	if *dryRunF {
+		fmt.Println("DRY RUN — not unsubscribing")
+		return
+	}
+	if *yesF { // -yes answers deletes only
+		fmt.Println("-yes: not unsubscribing")
+		return
+	}
+	fmt.Print("Unsubscribe? (y/N): ")
+	var ans string
+	fmt.Scanln(&ans)
+	if strings.ToLower(ans) != "y" {
+		return
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	for _, s := range senders {
+		resp, err := hc.Post(urls[s], "application/x-www-form-urlencoded",
+			strings.NewReader("List-Unsubscribe=One-Click"))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("HTTP %s", resp.Status)
+			}
+		}
+		if err != nil {
+			fmt.Printf("  ❌ %-40s %v\n", trim(s), err)
+		} else {
+			fmt.Printf("  ✓ %-40s unsubscribed\n", trim(s))
+		}
+	}
+}
+
+/* ── run metrics (-metrics-file) ──────────────────────── */
+
+// runMetrics counts what this run did, for -metrics-file.
+var runMetrics struct {
+	scanned, deleted, errors int64
+}
+
+// writeMetrics writes runMetrics in the Prometheus text format. The tool
+// exits after each run, so instead of serving /metrics it leaves a file
+// for node_exporter's textfile collector; the rename keeps a scrape from
+// reading it half-written.
+func writeMetrics(path string, start, end time.Time) error {
+	var b strings.Builder
+	for _, m := range []struct {
+		name, help string
+		val        float64
+	}{
+		{"imap_tool_messages_scanned", "Messages fetched by the last run", float64(atomic.LoadInt64(&runMetrics.scanned))},
+		{"imap_tool_messages_deleted", "Messages the last run deleted", float64(atomic.LoadInt64(&runMetrics.deleted))},
+		{"imap_tool_errors", "Failed accounts and unselectable folders in the last run", float64(atomic.LoadInt64(&runMetrics.errors))},
+		{"imap_tool_last_run_duration_seconds", "How long the last run took", end.Sub(start).Seconds()},
+		{"imap_tool_last_run_timestamp_seconds", "When the last run finished", float64(end.Unix())},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s.\n# TYPE %s gauge\n%s %s\n", m.name, m.help, m.name, m.name,
+			strconv.FormatFloat(m.val, 'f', -1, 64))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/* ── many accounts (-accounts) ────────────────────────── */
+
+type account struct {
+	Email, Pass, Host string
+}
+
+// loadAccounts reads email,password[,imap] rows; a leading "email" header
+// row, blank lines and #comments are skipped.
+func loadAccounts(path string) ([]account, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var out []account
+	for i, row := range rows {
+		if i == 0 && strings.EqualFold(row[0], "email") {
+			continue
+		}
+		if len(row) < 2 || row[0] == "" {
+			return nil, fmt.Errorf("%s: row %d: want email,password[,imap]", path, i+1)
+		}
+		a := account{Email: row[0], Pass: row[1]}
+		if len(row) > 2 {
+			a.Host = strings.TrimSpace(row[2])
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// perAccount turns all.tgz into all-user@example.com.tgz so accounts
+// don't overwrite each other's output.
+func perAccount(path, email string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	if strings.HasSuffix(path, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+	return strings.TrimSuffix(path, ext) + "-" + email + ext
+}
+
+// runAccounts runs the same operation for every account in path, one
+// after another; a failing account is reported and the rest still run.
+func runAccounts(path string, matching bool) error {
+	accts, err := loadAccounts(path)
+	if err != nil {
+		return err
+	}
+	if len(accts) == 0 {
+		return fmt.Errorf("%s: no accounts", path)
+	}
+	if *restoreF != "" {
+		return fmt.Errorf("-restore cannot be combined with -accounts")
+	}
+	backup, index, statsOut, logFile := *backupF, *indexF, *statsOutF, *logFileF
+	ckpt, foldRep, scanRes := *ckptF, *foldRepF, *scanResF
+	sendID, par, conc := *sendIDF, *backupParF, *concF
+	sums := make([]acctSum, len(accts))
+	errs := make([]error, len(accts))
+	for i, a := range accts {
+		fmt.Printf("\n👤 [%d/%d] %s\n", i+1, len(accts), a.Email)
+		*emailF, *passF, *imapF = a.Email, a.Pass, a.Host
+		*backupF, *indexF = perAccount(backup, a.Email), perAccount(index, a.Email)
+		*statsOutF, *logFileF = perAccount(statsOut, a.Email), perAccount(logFile, a.Email)
+		*ckptF, *foldRepF = perAccount(ckpt, a.Email), perAccount(foldRep, a.Email)
+		*scanResF = perAccount(scanRes, a.Email)
+		*sendIDF, *backupParF, *concF = sendID, par, conc // undo the last profile's tweaks
+		sums[i], errs[i] = runAccount(matching)
+		if errs[i] != nil {
+			atomic.AddInt64(&runMetrics.errors, 1)
+			log.Printf("❌ %s: %v", a.Email, errs[i])
+		}
+		exitIfInterrupted()
+	}
+
+	fmt.Println("\nAccounts")
+	var tot acctSum
+	var failed int
+	for i, a := range accts {
+		if errs[i] != nil {
+			failed++
+			fmt.Printf("  %-35s FAILED: %v\n", a.Email, errs[i])
+			continue
+		}
+		tot.Msgs += sums[i].Msgs
+		tot.Bytes += sums[i].Bytes
+		fmt.Printf("  %-35s %8d msgs  %8.1f MB\n", a.Email, sums[i].Msgs, float64(sums[i].Bytes)/(1024*1024))
+	}
+	fmt.Printf("  %-35s %8d msgs  %8.1f MB\n", "TOTAL", tot.Msgs, float64(tot.Bytes)/(1024*1024))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts failed", failed, len(accts))
+	}
+	return nil
+}
+
+/* ── connection diagnostics (-diagnose) ───────────────── */
+
+type probe struct {
+	Mode, Connect, TLS, Cert, Login, Err string
+	Caps                                 []string
+}
+
+var tlsNames = map[uint16]string{tls.VersionTLS10: "1.0", tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2", tls.VersionTLS13: "1.3"}
+
+// probeTLS fills p from a finished handshake: version and whether the
+// chain verifies for host (dialSmart itself never checks).
+func probeTLS(p *probe, host string, st tls.ConnectionState) {
+	p.TLS = tlsNames[st.Version]
+	if len(st.PeerCertificates) == 0 {
+		p.Cert = "none"
+		return
+	}
+	pool := x509.NewCertPool()
+	for _, c := range st.PeerCertificates[1:] {
+		pool.AddCert(c)
+	}
+	if _, err := st.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: pool}); err != nil {
+		p.Cert = "invalid"
+	} else {
+		p.Cert = "valid"
+	}
+}
+
+// probeCaps records CAPABILITY and whether LOGIN is allowed on cli.
+func probeCaps(p *probe, cli *client.Client) {
+	caps, err := cli.Capability()
+	if err != nil {
+		p.Login = "?"
+		return
+	}
+	p.Login = "yes"
+	for c := range caps {
+		p.Caps = append(p.Caps, c)
+		if c == "LOGINDISABLED" {
+			p.Login = "no"
+		}
+	}
+	sort.Strings(p.Caps)
+}
+
+// diagnose tries implicit TLS on 993, STARTTLS on 143 and (with
+// -allow-plain) plain 143 without logging in, and prints what works.
+func diagnose(host string) {
+	const wait = 10 * time.Second
+	// VerifyConnection only records the handshake: client.Client does not
+	// expose it after STARTTLS
+	var hs tls.ConnectionState
+	cfg := &tls.Config{ServerName: host, InsecureSkipVerify: true, Certificates: clientCerts,
+		VerifyConnection: func(st tls.ConnectionState) error { hs = st; return nil }}
+	var out []probe
+
+	p := probe{Mode: "993 TLS"}
+	t0 := time.Now()
+	if conn, err := tls.DialWithDialer(&net.Dialer{Timeout: wait}, "tcp", net.JoinHostPort(host, "993"), cfg); err != nil {
+		p.Connect, p.Err = "fail", err.Error()
+	} else if cli, err := client.New(conn); err != nil {
+		p.Connect, p.Err = "fail", err.Error()
+		conn.Close()
+	} else {
+		p.Connect = time.Since(t0).Round(time.Millisecond).String()
+		probeTLS(&p, host, hs)
+		probeCaps(&p, cli)
+		cli.Logout()
+	}
+	out = append(out, p)
+
+	modes := []string{"143 STARTTLS"}
+	if *allowPlnF {
+		modes = append(modes, "143 plain")
+	}
+	for _, mode := range modes {
+		p := probe{Mode: mode}
+		t0 := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "143"), wait)
+		var cli *client.Client
+		if err == nil {
+			cli, err = client.New(conn)
+		}
+		if err != nil {
+			p.Connect, p.Err = "fail", err.Error()
+			out = append(out, p)
+			continue
+		}
+		p.Connect = time.Since(t0).Round(time.Millisecond).String()
+		if mode == "143 STARTTLS" {
+			if err := cli.StartTLS(cfg); err != nil {
+				p.TLS, p.Err = "fail", err.Error()
+			} else {
+				probeTLS(&p, host, hs)
+			}
+		}
+		probeCaps(&p, cli)
+		cli.Logout()
+		out = append(out, p)
+	}
+
+	fmt.Printf("\n%s\n%-13s %-10s %-5s %-8s %-6s\n", host, "Mode", "Connect", "TLS", "Cert", "LOGIN")
+	for _, p := range out {
+		fmt.Printf("%-13s %-10s %-5s %-8s %-6s\n", p.Mode, p.Connect, p.TLS, p.Cert, p.Login)
+	}
+	for _, p := range out {
+		if p.Err != "" {
+			fmt.Printf("  %s: %s\n", p.Mode, p.Err)
+		}
+	}
+	for _, p := range out {
+		if len(p.Caps) > 0 {
+			fmt.Printf("\n%s capabilities:\n  %s\n", p.Mode, strings.Join(p.Caps, " "))
+		}
+	}
+}
+
+/* ── password sources ─────────────────────────────────── */
+
+// resolveToken reads -oauth-token like resolvePassword reads -password.
+func resolveToken() (string, error) {
+	switch *oauthF {
+	case "-":
+		return readSecret("OAuth token: ")
+	case "":
+		return os.Getenv("IMAP_OAUTH_TOKEN"), nil
+	}
+	return *oauthF, nil
+}
+
+// resolvePassword picks -password, then "-password -" (one line from
+// stdin, not echoed on a terminal), then $IMAP_PASSWORD; "" if none.
+func resolvePassword() (string, error) {
+	switch *passF {
+	case "-":
+		return readSecret("Password: ")
+	case "":
+		return os.Getenv("IMAP_PASSWORD"), nil
+	}
+	return *passF, nil
+}
+
+// passwordCommand runs -password-command and returns its trimmed stdout.
+// It runs on every login, so the password lives only as long as that
+// connection attempt instead of for the whole run.
+func passwordCommand() (string, error) {
+	sh, opt := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		sh, opt = "cmd", "/C"
+	}
+	c := exec.Command(sh, opt, *passCmdF)
+	c.Stdin, c.Stderr = os.Stdin, os.Stderr // let pass/gpg ask for a passphrase
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("-password-command: %w", err)
+	}
+	pw := strings.TrimSpace(string(out))
+	if pw == "" {
+		return "", fmt.Errorf("-password-command printed nothing")
+	}
+	return pw, nil
+}
+
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	// piped: read byte-wise so later prompts still get the rest of stdin
+	var b []byte
+	one := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(one)
+		if n == 1 && one[0] != '\n' {
+			b = append(b, one[0])
+			continue
+		}
+		if n == 1 || err == io.EOF {
+			return strings.TrimRight(string(b), "\r"), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+/* ── main ─────────────────────────────────────────────── */
+
+func main() {
+	flag.Parse()
+	if *printUIDsF || *streamF || *jsonF || *backupF == "-" {
+		// keep stdout for the UID list / records / archive; every status line goes to stderr
+		uidOut, os.Stdout = os.Stdout, os.Stderr
+	}
+	if *grepArchF != "" { // offline: needs only the index
+		if *indexF == "" {
+			log.Fatal("-grep-archive needs -index file.jsonl")
+		}
+		if err := grepArchive(*indexF, *grepArchF); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *diagF { // no login: -password is not needed
+		host := *imapF
+		if host == "" && profileFor(*emailF) != nil {
+			host = profileFor(*emailF).Host
+		}
+		if host == "" && *emailF != "" {
+			host = guessCandidates(*emailF)[0]
+		}
+		if host == "" {
+			log.Fatal("-diagnose needs -imap host or -email")
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		diagnose(host)
+		return
+	}
+	if *passCmdF != "" && *passF != "" {
+		log.Fatal("use -password or -password-command, not both")
+	}
+	if *passF != "" || *passCmdF != "" || *acctsF != "" {
+		if *oauthF != "" {
+			log.Fatal("-oauth-token replaces -password/-password-command and is for a single account")
+		}
+		// an explicit password or -accounts wins over $IMAP_OAUTH_TOKEN
+	} else if tok, err := resolveToken(); err != nil {
+		log.Fatal("oauth-token:", err)
+	} else {
+		*oauthF = tok
+	}
+	if *acctsF == "" && (*passCmdF != "" || *oauthF != "") {
+		if *emailF == "" {
+			flag.Usage()
+			return
+		}
+	} else if *acctsF == "" {
+		pw, err := resolvePassword()
+		if err != nil {
+			log.Fatal("password:", err)
+		}
+		if *emailF == "" || pw == "" {
+			flag.Usage()
+			return
+		}
+		*passF = pw
+	}
+	if (*certF == "") != (*keyF == "") {
+		log.Fatal("-tls-client-cert and -tls-client-key go together")
+	}
+	if *certF != "" {
+		pair, err := tls.LoadX509KeyPair(*certF, *keyF)
+		if err != nil {
+			log.Fatal("client certificate:", err)
+		}
+		clientCerts = []tls.Certificate{pair}
+	}
+	if *detectF {
+		imap.CharsetReader = detectCharsetReader
+	}
+	if *tmplF != "" {
+		var err error
+		if rowTmpl, err = parseRowTemplate(*tmplF); err != nil {
+			log.Fatal("-template:", err)
+		}
+	}
+	if *matchHdrF != "" {
+		*fieldF = strings.ToLower(*matchHdrF)
+	}
+	if strings.Contains(*fieldF, ",") {
+		var flds []string
+		for _, f := range strings.Split(strings.ToLower(*fieldF), ",") {
+			if f = strings.TrimSpace(f); f == "folder" || f == "size" {
+				log.Fatalf("-field %s cannot be part of a field list", f)
+			} else if f != "" {
+				flds = append(flds, f)
+			}
+		}
+		*fieldF = strings.Join(flds, ",")
+	}
+	*matchF = norm.NFC.String(*matchF) // the SEARCH term too; mail headers are mostly NFC
+	if *betweenF != "" {
+		var err error
+		if winSince, winBefore, err = parseBetween(*betweenF); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *olderF != "" {
+		t, err := parseAgeSpec(*olderF)
+		if err != nil {
+			log.Fatal("-older-than: ", err)
+		}
+		if winBefore.IsZero() || t.Before(winBefore) {
+			winBefore = t
+		}
+	}
+	if *newerF != "" {
+		t, err := parseAgeSpec(*newerF)
+		if err != nil {
+			log.Fatal("-newer-than: ", err)
+		}
+		if t.After(winSince) {
+			winSince = t
 		}
-		return nil, fmt.Errorf("unsupported port")
 	}
-	if c, err := connect(mod); err == nil {
-		fmt.Println("✅  Modern TLS")
-		return c, nil
+	if !winSince.IsZero() && !winBefore.IsZero() && !winSince.Before(winBefore) {
+		log.Fatalf("empty date window: newer than %s and older than %s", winSince.Format("2006-01-02"), winBefore.Format("2006-01-02"))
 	}
-	if c, err := connect(leg); err == nil {
-		fmt.Println("⚠️  Legacy TLS")
-		return c, nil
+	if *keepRecF != "" {
+		var err error
+		if recentCut, err = parseAgeSpec(*keepRecF); err != nil {
+			log.Fatal("-keep-recent: ", err)
+		}
 	}
-	if port == "143" && *allowPlnF {
-		fmt.Println("⚠️  Plain IMAP")
-		return client.Dial(addr)
+	if *bkMaxF != "" {
+		var err error
+		if bkMaxSize, err = parseSize(*bkMaxF); err != nil || bkMaxSize <= 0 {
+			log.Fatalf("-backup-skip-larger: bad size %q", *bkMaxF)
+		}
 	}
-	return nil, fmt.Errorf("TLS failed")
-}
-
-func guessServer(email string) string {
-	d := strings.Split(email, "@")[1]
-	for _, p := range []string{"imap.", "mail.", ""} {
-		h := p + d + ":993"
-		if _, err := tls.Dial("tcp", h, &tls.Config{InsecureSkipVerify: true}); err == nil {
-			return h
+	if *resTokF != "" {
+		if *acctsF != "" {
+			log.Fatal("-resume-token is per account; it can't be combined with -accounts")
+		}
+		var err error
+		if resumeTok, err = parseResumeToken(*resTokF); err != nil {
+			log.Fatal("-resume-token: ", err)
 		}
 	}
-	return d + ":143"
-}
-
-/* ── backup & restore ─────────────────────────────────── */
-
-func backupAll(cli *client.Client, tgz string) error {
-	f, err := os.Create(tgz)
-	if err != nil {
-		return err
+	for _, p := range strings.Split(*foldersF, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("-folders: bad pattern %q", p)
+		}
+		folderPats = append(folderPats, p)
 	}
-	defer f.Close()
-	gw := gzip.NewWriter(f)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
-
-	var folders, msgs int64
-	mbc := make(chan *imap.MailboxInfo, 64)
-	go func() { _ = cli.List("", "*", mbc) }()
-	for mb := range mbc {
-		sel := true
-		for _, a := range mb.Attributes {
-			if a == imap.NoSelectAttr {
-				sel = false
-			}
+	for _, t := range strings.Split(*subjAnyF, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			subjTerms = append(subjTerms, t)
 		}
-		if !sel {
-			continue
+	}
+	if *regexF {
+		if *matchF == "" {
+			log.Fatal("-regex needs -match")
 		}
-		if _, e := cli.Select(mb.Name, false); e != nil {
-			continue
+		if *fuzzyF {
+			log.Fatal("-regex and -fuzzy can't be combined")
 		}
-		uids, _ := cli.Search(imap.NewSearchCriteria())
-		if len(uids) == 0 {
-			continue
+		expr := *matchF
+		if !strings.HasPrefix(expr, "(?") {
+			expr = "(?i)" + expr
 		}
-		folders++
-		seq := new(imap.SeqSet)
-		seq.AddNum(uids...)
-		msgCh := make(chan *imap.Message, 32)
-		go func() { _ = cli.Fetch(seq, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822}, msgCh) }()
-		for m := range msgCh {
-			if m == nil {
-				continue
-			}
-			data, _ := io.ReadAll(m.GetBody(&imap.BodySectionName{}))
-			h := &tar.Header{Name: fmt.Sprintf("%s/%d.eml", mb.Name, m.Uid), Size: int64(len(data)), Mode: 0600}
-			tw.WriteHeader(h)
-			tw.Write(data)
-			msgs++
-			fmt.Printf("\r📦 Backup folders:%d msgs:%d", folders, msgs)
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatal("-match: ", err)
 		}
+		matchRe = re
+	}
+	if r := *matchRcvF; len(r) > 2 && strings.HasPrefix(r, "/") && strings.HasSuffix(r, "/") {
+		re, err := regexp.Compile("(?i)" + r[1:len(r)-1])
+		if err != nil {
+			log.Fatal("-match-received:", err)
+		}
+		rcvRe = re
+	}
+	if *planOutF != "" {
+		if *planInF != "" {
+			log.Fatal("-export-plan and -execute-plan are separate runs")
+		}
+		*dryRunF = true // a plan is only ever written instead of deleting
+	}
+	if *sortF != "count" && *sortF != "size" {
+		log.Fatal("-sort must be count or size")
+	}
+	switch *matchAuthF {
+	case "", "pass", "fail", "none":
+	default:
+		log.Fatal("-match-auth must be pass, fail or none")
+	}
+	matching := *matchF != "" || len(subjTerms) > 0 || *attTypeF != "" || *matchRcvF != "" || *matchAuthF != ""
+	if *jsonF && matching {
+		log.Fatal("-json is for the stats table; use -print-uids or -stream-json with -match")
+	}
+	if *byFoldF && (*fieldF == "folder" || matching) {
+		log.Fatal("-by-folder splits the stats table by folder; it needs another -field and no -match")
+	}
+	if (*fieldF == "folder" || *fieldF == "size") && matching {
+		log.Fatalf("-field %s is for the stats table only", *fieldF)
+	}
+	switch *collF {
+	case "", "skip", "keep-both", "replace":
+	default:
+		log.Fatal("-restore-collision must be skip, keep-both or replace")
+	}
+	if *delimF != "" && utf8.RuneCountInString(*delimF) != 1 {
+		log.Fatalf("-delimiter must be a single character, got %q", *delimF)
+	}
+	if *restSrcF != "native" && *restSrcF != "maildir" {
+		log.Fatal("-restore-source must be native or maildir")
+	}
+	if (*backupF != "" || *restoreF != "") && matching {
+		log.Fatal("-match cannot be combined with backup/restore")
+	}
+	if _, ok := dedupKeys[*dedupKeyF]; !ok {
+		log.Fatal("-dedup-key must be message-id, subject+date or body-hash")
+	}
+	if *dedupKeyF != "message-id" && !*dedupF {
+		log.Fatal("-dedup-key needs -dedup")
+	}
+	if *dedupMvF != "" {
+		if !*dedupF {
+			log.Fatal("-dedup-move needs -dedup")
+		}
+		if *moveF != "" && *moveF != *dedupMvF {
+			log.Fatal("use -dedup-move or -move, not both")
+		}
+		*moveF = *dedupMvF // wipe's -move path does the rest
+	}
+	if (*backupF == "-" || *restoreF == "-") && *acctsF != "" {
+		log.Fatal("\"-\" is a single stream; use archive file names with -accounts")
+	}
+	if *restoreF == "-" && (*passF == "-" || *oauthF == "-") {
+		log.Fatal("-restore - reads the archive from stdin, so the password can't come from there")
+	}
+	switch *markF {
+	case "", "read", "unread":
+	default:
+		log.Fatal("-mark must be read or unread")
+	}
+	if *markF != "" && (*moveF != "" || *safeF || *dedupF || *stripF || *planOutF != "" || *planInF != "") {
+		log.Fatal("-mark only sets flags; it cannot be combined with -move, -safe, -dedup, -strip-attachments or plans")
+	}
+	if *markF != "" && *ckptF != "" {
+		// its UIDs would read as "already deleted" to a later delete run
+		log.Fatal("-checkpoint records deletions; -mark is safe to rerun without it")
+	}
+	if *stripF {
+		if !matching || *exportF == "" {
+			log.Fatal("-strip-attachments needs -match to pick the messages and -export DIR for the attachments")
+		}
+		var err error
+		if stripMin, err = parseSize(*stripMinF); err != nil || stripMin <= 0 {
+			log.Fatalf("-min-size: bad size %q", *stripMinF)
+		}
+	}
+	// -yes only ever answers for an explicit selection, never for the
+	// stats table, where "all" is one keystroke away
+	if *yesF && !matching && *draftsF == "" && !*dedupF && *uidsFileF == "" && *planInF == "" {
+		log.Fatal("-yes needs -match (or -clean-drafts, -dedup, -uids-file, -execute-plan); the stats table is interactive")
+	}
+	if *yesF && *matchTblF {
+		log.Fatal("-yes cannot answer the -match-preview-table pages")
 	}
-	fmt.Print("\r                                        \r")
-	return nil
-}
 
-func restoreAll(cli *client.Client, tgz string) error {
-	f, err := os.Open(tgz)
+	watchSignals()
+	start := time.Now()
+	var err error
+	if *acctsF != "" {
+		err = runAccounts(*acctsF, matching)
+	} else if _, err = runAccount(matching); err != nil {
+		atomic.AddInt64(&runMetrics.errors, 1)
+	}
+	if *metricsF != "" {
+		if e := writeMetrics(*metricsF, start, time.Now()); e != nil {
+			log.Println("metrics-file:", e)
+		}
+	}
+	exitIfInterrupted()
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	defer f.Close()
-	gr, _ := gzip.NewReader(f)
-	defer gr.Close()
-	tr := tar.NewReader(gr)
+}
 
-	var restored int64
-	for {
-		h, e := tr.Next()
-		if e == io.EOF {
-			break
+// acctSum is what one account contributed to a run.
+type acctSum struct {
+	Msgs, Bytes int64
+}
+
+// runAccount connects as -email/-password and performs the selected
+// operation: quota, clean-drafts, dedup, backup, restore, or a stats/match scan.
+func runAccount(matching bool) (sum acctSum, err error) {
+	// connect
+	prof := profileFor(*emailF)
+	if prof != nil {
+		note("🏷  %s profile (auth: %s)", prof.Name, prof.Auth)
+		if prof.Note != "" {
+			note("   note: %s", prof.Note)
 		}
-		if h.FileInfo().IsDir() {
-			continue
+		if prof.NeedsID {
+			*sendIDF = true
 		}
-		fold := filepath.Dir(h.Name)
-		if fold == "." {
-			fold = "INBOX"
+		if prof.MaxConns > 0 && *backupParF > prof.MaxConns {
+			note("   -backup-parallel capped at %d", prof.MaxConns)
+			*backupParF = prof.MaxConns
+		}
+		if prof.MaxConns > 0 && *concF > prof.MaxConns {
+			note("   -concurrency capped at %d", prof.MaxConns)
+			*concF = prof.MaxConns
 		}
-		cli.Create(fold)
-		data, _ := io.ReadAll(tr)
-		cli.Append(fold, nil, time.Now(), bytes.NewReader(data))
-		restored++
-		fmt.Printf("\r⬆️ Restore msgs:%d", restored)
 	}
-	fmt.Print("\r                                   \r")
-	return nil
-}
+	host := *imapF
+	if host == "" && prof != nil {
+		host = prof.Host
+	}
+	if host == "" && *noGuessF {
+		return sum, fmt.Errorf("-imap not set and -no-guess given (would have tried %s)",
+			strings.Join(guessCandidates(*emailF), ", "))
+	}
+	if host == "" {
+		var implicit bool
+		host, implicit = guessServer(*emailF)
+		implicitTLS[host] = implicit
+	}
+	cli, err := connect(host)
+	if err != nil {
+		return sum, err
+	}
+	defer func() { cli.Logout() }() // cli may be replaced by a reconnect
 
-/* ── main ─────────────────────────────────────────────── */
+	if *quotaF {
+		return showQuota(cli)
+	}
 
-func main() {
-	flag.Parse()
-	if *emailF == "" || *passF == "" {
-		flag.Usage()
+	if *draftsF != "" {
+		if err := cleanDrafts(cli, *draftsF); err != nil {
+			return sum, fmt.Errorf("clean-drafts: %w", err)
+		}
 		return
 	}
-	if (*backupF != "" || *restoreF != "") && *matchF != "" {
-		log.Fatal("-match cannot be combined with backup/restore")
+
+	if *dedupF {
+		if err := dedup(cli); err != nil {
+			return sum, fmt.Errorf("dedup: %w", err)
+		}
+		return
 	}
 
-	// connect
-	host := *imapF
-	if host == "" {
-		host = guessServer(*emailF)
+	if *planInF != "" {
+		return sum, executePlan(cli, *planInF)
 	}
-	cli, err := dialSmart(host)
-	if err != nil {
-		log.Fatal(err)
+	if *uidsFileF != "" {
+		return sum, deleteUIDFile(cli, *uidsFileF)
 	}
-	defer cli.Logout()
-	if err := cli.Login(*emailF, *passF); err != nil {
-		log.Fatal("login:", err)
+	if *foldRepF != "" {
+		return folderReport(cli, *foldRepF)
 	}
 
 	/* backup / restore shortcuts */
 	if *backupF != "" {
-		fmt.Println("🔄 Backup →", *backupF)
-		if err := backupAll(cli, *backupF); err != nil {
-			log.Fatal(err)
+		note("🔄 Backup → %s", *backupF)
+		if err := backupAll(cli, host, *backupF); err != nil {
+			return sum, err
 		}
 		fmt.Println("✓ backup done")
 		return
 	}
 	if *restoreF != "" {
-		fmt.Println("🔄 Restore ←", *restoreF)
+		note("🔄 Restore ← %s", *restoreF)
 		if err := restoreAll(cli, *restoreF); err != nil {
-			log.Fatal(err)
+			return sum, err
 		}
 		fmt.Println("✓ restore done")
 		return
 	}
 
-	statsMode := *matchF == ""
-	sizeOn := !statsMode || *sizeF
+	statsMode := !matching
+	sizeOn := !statsMode || *sizeF || *fieldF == "size" || *streamF || *sortF == "size"
 	if sizeOn {
-		fmt.Println("📏 Size counting ON")
+		note("📏 Size counting ON")
 	}
 
 	/* discover selectable folders */
-	folders := []string{"INBOX"}
+	var folders []string
+	if folderWanted("INBOX", "") {
+		folders = append(folders, "INBOX")
+	}
 	mbCh := make(chan *imap.MailboxInfo, 64)
 	go func() { _ = cli.List("", "*", mbCh) }()
 	for mb := range mbCh {
@@ -316,153 +6109,414 @@ func main() {
 				break
 			}
 		}
-		if selectable && mb.Name != "INBOX" {
+		if selectable && *exclSelfF && isSentFolder(mb) {
+			note("🙋 -exclude-self: skipping %s", mb.Name)
+			continue
+		}
+		if selectable && mb.Name != "INBOX" && folderWanted(mb.Name, mb.Delimiter) {
 			folders = append(folders, mb.Name)
 		}
 	}
+	if len(folders) == 0 {
+		return sum, fmt.Errorf("no folder matches -folders %q", *foldersF)
+	}
+
+	if *replF {
+		repl(cli, folders)
+		return
+	}
 
 	buckets := map[string]*bucket{}
-	target := &bucket{Key: *matchF, ByFolder: map[string][]uint32{}}
-	var totMsgs, matchMsgs int64
+	target := &bucket{Key: matchDesc(), ByFolder: map[string][]uint32{}}
+	phraseHits := map[string]int{}
+	unsubURLs := map[string]string{}
+	spans := map[string][2]time.Time{} // oldest/newest match per folder
+	folderBytes := map[string]int64{}
+	var totMsgs, matchMsgs, excluded, selfMsgs int64
+	var stream *json.Encoder
+	if *streamF {
+		stream = json.NewEncoder(uidOut)
+	}
 
-	for i, folder := range folders {
-		cli.Select(folder, false)
-		crit := imap.NewSearchCriteria()
-		if !statsMode {
-			crit.Header.Add(strings.Title(*fieldF), *matchF)
+	if !statsMode && *sampleF {
+		if !sampleMatch(cli, folders[0], sizeOn) {
+			return
 		}
-		uids, _ := cli.Search(crit)
-		if len(uids) == 0 && statsMode {
-			crit = imap.NewSearchCriteria()
-			uids, _ = cli.Search(crit)
+	}
+
+	// -precompute-total: one STATUS pass up front gives a grand total for
+	// a percentage; the counts also serve the empty-folder skip below
+	counts := map[string]uint32{}
+	var grand, scanned uint32
+	if *precompF {
+		for i, folder := range folders {
+			if st, err := cli.Status(folder, []imap.StatusItem{imap.StatusMessages}); err == nil {
+				counts[folder] = st.Messages
+				grand += st.Messages
+			} else {
+				counts[folder] = 1 // unknown: let the scan find out
+			}
+			progress("⏳ %2d/%2d folders counted  total:%d", i+1, len(folders), grand)
 		}
-		if len(uids) == 0 {
-			continue
+		progressDone()
+	}
+	pct := func() string {
+		if grand == 0 {
+			return ""
 		}
-		seq := new(imap.SeqSet)
-		seq.AddNum(uids...)
-		items := []imap.FetchItem{imap.FetchEnvelope}
-		if sizeOn {
-			items = append(items, imap.FetchRFC822Size)
+		return fmt.Sprintf("  %3.0f%%", float64(scanned)*100/float64(grand))
+	}
+
+	var skipped, failedSel, resumed, tokDone int
+	var rs *scanState
+	if statsMode && *scanResF != "" && stream == nil {
+		rs = loadScanState(*scanResF)
+	}
+	// the outgoing token starts from the incoming one so a chain of runs
+	// accumulates; it is printed when this run ends incomplete
+	tok := &resumeToken{V: 1, Email: *emailF, Sig: tokenSig(statsMode), Folders: map[string]tokenFolder{}}
+	if resumeTok != nil {
+		if resumeTok.Email != *emailF || resumeTok.Sig != tok.Sig {
+			return sum, fmt.Errorf("-resume-token is for %s with other options; rerun with the original flags", resumeTok.Email)
 		}
-		mc := make(chan *imap.Message, 32)
-		go func() { _ = cli.Fetch(seq, items, mc) }()
-		for m := range mc {
+		tok = resumeTok
+	}
+	printToken := func() {
+		fmt.Printf("\n🎫 continue with: -resume-token %s\n", tok)
+	}
+	// -concurrency: each connection takes whole folders off one queue;
+	// mu guards everything the folders add up into
+	conns := []*client.Client{cli}
+	for len(conns) < *concF && len(conns) < len(folders) {
+		c, err := connect(host)
+		if err != nil {
+			fmt.Printf("⚠️  -concurrency: scanning with %d connections: %v\n", len(conns), err)
+			break
+		}
+		conns = append(conns, c)
+	}
+	var mu sync.Mutex
+	var finished int  // folders done, over all connections
+	var fetched int64 // msgs looked at, for the rate and ETA
+	scanStart := time.Now()
+	scanOne := func(cp **client.Client, folder string) {
+		seen := map[uint32]bool{} // handled by this run, an earlier attempt or an earlier run
+		if resumeTok != nil {
+			mu.Lock()
+			done, whole := tok.skipFor(*cp, folder)
+			if whole {
+				tokDone++
+				finished++
+				scanned += counts[folder]
+				progress("⏳ %2d/%2d folders  done earlier:%d%s", finished, len(folders), tokDone, pct())
+			}
+			mu.Unlock()
+			if whole {
+				return
+			}
+			for u := range done {
+				seen[u] = true
+			}
+		}
+		// STATUS is cheaper than SELECT+SEARCH for the many empty folders
+		n, ok := counts[folder]
+		if !ok {
+			if st, err := (*cp).Status(folder, []imap.StatusItem{imap.StatusMessages}); err == nil {
+				n, ok = st.Messages, true
+			}
+		}
+		if ok && n == 0 {
+			mu.Lock()
+			skipped++
+			finished++
+			progress("⏳ %2d/%2d folders  skipped:%d", finished, len(folders), skipped)
+			mu.Unlock()
+			return
+		}
+		var fs *folderState
+		if rs != nil {
+			mu.Lock()
+			f, cached := rs.begin(*cp, folder)
+			if cached {
+				for k, c := range f.Buckets {
+					if buckets[k] == nil {
+						buckets[k] = &bucket{Key: k, ByFolder: map[string][]uint32{}}
+					}
+					buckets[k].Cnt += c.Cnt
+					buckets[k].Bytes += c.Bytes
+					buckets[k].ByFolder[folder] = c.ByFolder[folder]
+					totMsgs += int64(c.Cnt)
+				}
+				resumed++
+				finished++
+				scanned += counts[folder]
+				progress("⏳ %2d/%2d folders  msgs:%d  cached:%d%s", finished, len(folders), totMsgs, resumed, pct())
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+			fs = f
+		}
+		scanMsg := func(m *imap.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched++
+			if *exclSelfF && fromSelf(m) {
+				selfMsgs++
+				return
+			}
 			if statsMode {
-				key := classify(m, *fieldF)
+				key := folder
+				if *fieldF != "folder" {
+					key = classify(m, *fieldF)
+				}
+				if stream != nil {
+					totMsgs++
+					sum.Bytes += int64(m.Size)
+					_ = stream.Encode(newStreamRec(folder, key, m))
+					return
+				}
+				if *byFoldF {
+					key = folder + byFolderSep + key
+				}
 				if buckets[key] == nil {
 					buckets[key] = &bucket{Key: key, ByFolder: map[string][]uint32{}}
 				}
-				buckets[key].add(folder, m.SeqNum, int64(m.Size))
+				buckets[key].add(folder, m.Uid, int64(m.Size))
 				totMsgs++
-			} else if strings.Contains(strings.ToLower(classify(m, *fieldF)), strings.ToLower(*matchF)) {
-				target.add(folder, m.SeqNum, int64(m.Size))
+				if fs != nil {
+					fs.add(folder, key, m.Uid, int64(m.Size))
+				}
+			} else if isMatch(m) {
+				if isExcluded(m) {
+					excluded++
+					return
+				}
+				if stream != nil {
+					matchMsgs++
+					sum.Bytes += int64(m.Size)
+					_ = stream.Encode(newStreamRec(folder, "", m))
+					return
+				}
+				target.add(folder, m.Uid, int64(m.Size))
+				folderBytes[folder] += int64(m.Size)
+				if d := dateOf(m); !d.IsZero() {
+					sp := spans[folder]
+					if sp[0].IsZero() || d.Before(sp[0]) {
+						sp[0] = d
+					}
+					if d.After(sp[1]) {
+						sp[1] = d
+					}
+					spans[folder] = sp
+				}
 				matchMsgs++
+				for _, t := range subjectHits(m) {
+					phraseHits[t]++
+				}
+				if *unsubF {
+					from := classify(m, "from")
+					if u := oneClickURL(m); u != "" && unsubURLs[from] == "" {
+						unsubURLs[from] = u
+					}
+				}
 			}
 		}
+		err := withReconnect(cp, host, folder, func(c *client.Client) error {
+			return scanFolder(c, folder, statsMode, sizeOn, seen, func(m *imap.Message) {
+				seen[m.Uid] = true
+				scanMsg(m)
+			})
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		tok.record(*cp, folder, seen, err == nil)
+		if err != nil {
+			failedSel++
+			atomic.AddInt64(&runMetrics.errors, 1)
+			log.Printf("\n⚠️  skip %s: %v", folder, err)
+		} else if fs != nil {
+			rs.finish(folder, fs)
+		}
+		scanned += counts[folder]
+		finished++
 		if statsMode {
-			fmt.Printf("\r⏳ %2d/%2d folders  msgs:%d", i+1, len(folders), totMsgs)
+			progress("⏳ %2d/%2d folders  msgs:%d%s%s", finished, len(folders), totMsgs, pct(), rate(scanStart, fetched, int64(grand)))
 		} else {
-			fmt.Printf("\r⏳ %2d/%2d folders  matches:%d", i+1, len(folders), matchMsgs)
+			progress("⏳ %2d/%2d folders  matches:%d%s%s", finished, len(folders), matchMsgs, pct(), rate(scanStart, fetched, int64(grand)))
+		}
+	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for k := range conns {
+		wg.Add(1)
+		go func(cp **client.Client) {
+			defer wg.Done()
+			for folder := range jobs {
+				scanOne(cp, folder)
+			}
+		}(&conns[k])
+	}
+	for _, folder := range folders {
+		if interrupted() {
+			break
+		}
+		jobs <- folder
+	}
+	close(jobs)
+	wg.Wait()
+	cli = conns[0]
+	for _, c := range conns[1:] {
+		c.Logout()
+	}
+	if interrupted() {
+		printToken()
+		return sum, fmt.Errorf("scan interrupted")
+	}
+	progressDone()
+	if tokDone > 0 {
+		note("🎫 %d folders were finished by an earlier run", tokDone)
+	}
+	if failedSel > 0 {
+		printToken()
+	}
+	if stream != nil {
+		sum.Msgs = totMsgs + matchMsgs
+		fmt.Printf("✓ streamed %d msgs\n", sum.Msgs)
+		return
+	}
+	if statsMode {
+		sum = acctSum{totMsgs, 0}
+		for _, b := range buckets {
+			sum.Bytes += b.Bytes
 		}
+	} else {
+		sum = acctSum{int64(target.Cnt), target.Bytes}
+	}
+	if skipped > 0 {
+		note("⏭  skipped %d empty folders", skipped)
+	}
+	if selfMsgs > 0 {
+		fmt.Printf("🙋 skipped %d msgs from %s\n", selfMsgs, *emailF)
+	}
+	if *limitF > 0 {
+		fmt.Printf("🎲 -limit %d: the figures below are a sample of the newest mail, not totals\n", *limitF)
+	}
+	if failedSel > 0 {
+		fmt.Printf("⚠️  %d folders could not be scanned and are missing or incomplete\n", failedSel)
 	}
-	fmt.Print("\r                                             \r")
 
 	/* match mode output & delete */
 	if !statsMode {
+		if excluded > 0 {
+			fmt.Printf("🛡  excluded %d matching %q (%s)\n", excluded, *excludeF, excludeField())
+		}
 		if target.Cnt == 0 {
 			fmt.Println("Nothing matches")
 			return
 		}
-		fmt.Printf("\nMatches for \"%s\" (%s)\n", *matchF, *fieldF)
+		fmt.Printf("\nMatches for %s\n", matchDesc())
+		paged := *matchTblF && !*reportF
 		for f, ids := range target.ByFolder {
-			fmt.Printf("  %-35s %6d\n", f, len(ids))
+			if paged { // matchTable shows the folders
+				break
+			}
+			if sp := spans[f]; !sp[0].IsZero() {
+				fmt.Printf("  %-35s %6d  %s to %s\n", f, len(ids), sp[0].Format("2006-01"), sp[1].Format("2006-01"))
+			} else {
+				fmt.Printf("  %-35s %6d\n", f, len(ids))
+			}
+		}
+		if len(subjTerms) > 0 {
+			fmt.Println("Hits per phrase:")
+			for _, t := range subjTerms {
+				fmt.Printf("  %-35q %6d\n", t, phraseHits[t])
+			}
 		}
 		fmt.Printf("Total: %d msgs  %.1f MB\n", target.Cnt, float64(target.Bytes)/(1024*1024))
-		fmt.Print("Delete? (y/N): ")
-		var ans string
-		fmt.Scanln(&ans)
-		if strings.ToLower(ans) == "y" {
-			wipe(cli, target.ByFolder)
+		if *printUIDsF {
+			printUIDs(uidOut, target.ByFolder)
+		}
+		if *unsubF && !*reportF {
+			unsubscribe(unsubURLs)
+		}
+		if *reportF {
+			return
 		}
+		if *stripF {
+			if err := stripAttachments(cli, target.ByFolder); err != nil {
+				return sum, fmt.Errorf("strip-attachments: %w", err)
+			}
+			return
+		}
+		if paged {
+			matchTable(cli, target, folderBytes)
+			return
+		}
+		matchDelete(cli, target.ByFolder)
 		return
 	}
 
 	/* stats mode table */
-	type pair struct{ b *bucket }
-	var list []pair
+	var list []*bucket
 	for _, v := range buckets {
-		list = append(list, pair{v})
+		list = append(list, v)
 	}
 	if len(list) == 0 {
 		fmt.Println("Mailbox empty")
+		if *jsonF {
+			fmt.Fprintln(uidOut, "[]")
+		}
 		return
 	}
-	sort.Slice(list, func(i, j int) bool { return list[i].b.Cnt > list[j].b.Cnt })
-
-	page := 0
-	for {
-		start, end := page*pageSz, (page+1)*pageSz
-		if start >= len(list) {
-			fmt.Println("End")
-			return
-		}
-		if end > len(list) {
-			end = len(list)
+	sort.Slice(list, func(i, j int) bool { return list[i].Cnt > list[j].Cnt })
+	if *sortF == "size" {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Bytes > list[j].Bytes })
+	}
+	if *fieldF == "size" && *sortF != "size" { // a histogram reads best smallest-first
+		rank := map[string]int{}
+		for i, c := range sizeClasses {
+			rank[c.Label] = i
 		}
-		fmt.Printf("\n%s %d‑%d / %d\n", strings.ToUpper(*fieldF), start+1, end, len(list))
-		if sizeOn {
-			fmt.Println("┌────┬──────────────────────────────────────────┬────────┬────────┐")
-			fmt.Printf("│  # │ %-40s │  MSGS  │  MB │\n", strings.ToUpper(*fieldF))
-			fmt.Println("├────┼──────────────────────────────────────────┼────────┼────────┤")
+		sort.Slice(list, func(i, j int) bool { return rank[list[i].Key] < rank[list[j].Key] })
+	}
+
+	groups := []statGroup{{"", list}}
+	if *byFoldF {
+		groups = splitByFolder(list, folders)
+	}
+
+	if *statsOutF != "" {
+		if err := writeStats(*statsOutF, groups, sizeOn); err != nil {
+			log.Println("stats-out:", err)
 		} else {
-			fmt.Println("┌────┬──────────────────────────────────────────┬────────┐")
-			fmt.Printf("│  # │ %-40s │  MSGS  │\n", strings.ToUpper(*fieldF))
-			fmt.Println("├────┼──────────────────────────────────────────┼────────┤")
+			fmt.Println("📝 Stats →", *statsOutF)
 		}
-		for i := start; i < end; i++ {
-			b := list[i].b
-			if sizeOn {
-				fmt.Printf("│ %2d │ %-40s │ %6d │ %6.1f │\n", i-start+1, trim(b.Key), b.Cnt, float64(b.Bytes)/(1024*1024))
-			} else {
-				fmt.Printf("│ %2d │ %-40s │ %6d │\n", i-start+1, trim(b.Key), b.Cnt)
+	}
+
+	if *jsonF {
+		return sum, writeJSON(uidOut, groups, sizeOn)
+	}
+
+	if rowTmpl != nil { // -template replaces the interactive table
+		for _, g := range groups {
+			for _, b := range g.List {
+				if err := rowTmpl.Execute(os.Stdout, b); err != nil {
+					return sum, fmt.Errorf("template: %w", err)
+				}
+				fmt.Println()
 			}
 		}
-		if sizeOn {
-			fmt.Println("└────┴──────────────────────────────────────────┴────────┴────────┘")
-		} else {
-			fmt.Println("└────┴──────────────────────────────────────────┴────────┘")
+		return
+	}
+
+	for _, g := range groups {
+		if g.Folder != "" {
+			fmt.Printf("\n📁 %s\n", g.Folder)
 		}
-		fmt.Print("num=del  n/p  q : ")
-		var in string
-		fmt.Scanln(&in)
-		switch strings.ToLower(in) {
-		case "n":
-			page++
-		case "p":
-			if page > 0 {
-				page--
-			}
-		case "q":
+		if statsTable(cli, g.List, sizeOn) {
 			return
-		default:
-			idx, err := strconv.Atoi(in)
-			if err != nil || idx < 1 || idx > end-start {
-				fmt.Println("bad input")
-				continue
-			}
-			b := list[start+idx-1].b
-			fmt.Printf("Delete ALL for \"%s\" (%d)? (y/N): ", b.Key, b.Cnt)
-			var confirm string
-			fmt.Scanln(&confirm)
-			if strings.ToLower(confirm) == "y" {
-				wipe(cli, b.ByFolder)
-				list = append(list[:start+idx-1], list[start+idx:]...)
-				if start >= len(list) && page > 0 {
-					page--
-				}
-			}
 		}
 	}
+	return
 }
-
@@ -0,0 +1,1697 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+/* ── fake IMAP server ─────────────────────────────────── */
+
+// go-imap's memory backend needs go-message, which this module does not
+// pull in; the tests talk to this one instead. It knows just enough of
+// RFC 3501 plus UIDPLUS, MULTIAPPEND and MOVE for the code under test.
+
+type fakeMsg struct {
+	uid   uint32
+	flags []string
+	date  time.Time
+	body  []byte
+}
+
+type fakeBox struct {
+	validity, next uint32
+	msgs           []*fakeMsg
+}
+
+type fakeServer struct {
+	ln    net.Listener
+	caps  []string
+	delim string
+
+	mu          sync.Mutex
+	boxes       map[string]*fakeBox
+	order       []string        // LIST order
+	failSelect  map[string]bool // SELECT answers NO, STATUS still works
+	cmds        []string        // command names as received, "UID " included
+	beforeStore func(s *fakeServer)
+	structure   string // BODYSTRUCTURE of every message; "" a single text/plain part
+}
+
+func newFakeServer(t *testing.T, caps ...string) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, caps: append([]string{"IMAP4rev1"}, caps...), delim: "/",
+		boxes: map[string]*fakeBox{}, failSelect: map[string]bool{}}
+	s.addBox("INBOX")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeServer) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeServer) addBox(name string) *fakeBox {
+	if b := s.boxes[name]; b != nil {
+		return b
+	}
+	b := &fakeBox{validity: uint32(1000 + len(s.order)), next: 1}
+	s.boxes[name] = b
+	s.order = append(s.order, name)
+	return b
+}
+
+// add stores a message in box under uid (0: the next free one).
+func (s *fakeServer) add(box string, uid uint32, flags []string, date time.Time, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.addBox(box)
+	if uid == 0 {
+		uid = b.next
+	}
+	b.msgs = append(b.msgs, &fakeMsg{uid, flags, date, []byte(body)})
+	if uid >= b.next {
+		b.next = uid + 1
+	}
+}
+
+// uids lists the UIDs left in box.
+func (s *fakeServer) uids(box string) []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []uint32
+	if b := s.boxes[box]; b != nil {
+		for _, m := range b.msgs {
+			out = append(out, m.uid)
+		}
+	}
+	return out
+}
+
+// count reports how many commands named cmd the server received.
+func (s *fakeServer) count(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+// login opens a logged-in client connection, closed with the test.
+func (s *fakeServer) login(t *testing.T) *client.Client {
+	t.Helper()
+	c, err := client.Dial(s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login("me@example.com", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	return c
+}
+
+var literalRe = regexp.MustCompile(`\{(\d+)(\+?)\}\r\n$`)
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "* OK [CAPABILITY %s] fake ready\r\n", strings.Join(s.caps, " "))
+	w.Flush()
+	sess := &fakeSession{s: s, w: w}
+	for {
+		var raw []byte
+		for { // a command line, with its literals spliced in
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			raw = append(raw, line...)
+			m := literalRe.FindSubmatch(line)
+			if m == nil {
+				break
+			}
+			if len(m[2]) == 0 {
+				w.WriteString("+ go ahead\r\n")
+				w.Flush()
+			}
+			n, _ := strconv.Atoi(string(m[1]))
+			lit := make([]byte, n)
+			if _, err := io.ReadFull(r, lit); err != nil {
+				return
+			}
+			raw = append(raw, lit...)
+		}
+		p := &tokParser{b: raw}
+		toks := p.list()
+		if len(toks) < 2 {
+			w.WriteString("* BAD empty command\r\n")
+			w.Flush()
+			continue
+		}
+		more := sess.handle(str(toks[0]), toks[1:])
+		w.Flush()
+		if !more {
+			return
+		}
+	}
+}
+
+/* request parsing: atoms and quoted strings are strings, literals
+   []byte, parenthesized lists []interface{} */
+
+type tokParser struct {
+	b []byte
+	i int
+}
+
+func (p *tokParser) list() []interface{} {
+	var out []interface{}
+	for p.i < len(p.b) {
+		switch c := p.b[p.i]; c {
+		case ' ', '\r', '\n':
+			p.i++
+		case ')':
+			p.i++
+			return out
+		case '(':
+			p.i++
+			out = append(out, p.list())
+		case '"':
+			out = append(out, p.quoted())
+		case '{':
+			out = append(out, p.literal())
+		default:
+			out = append(out, p.atom())
+		}
+	}
+	return out
+}
+
+func (p *tokParser) quoted() string {
+	var b strings.Builder
+	for p.i++; p.i < len(p.b) && p.b[p.i] != '"'; p.i++ {
+		if p.b[p.i] == '\\' {
+			p.i++
+		}
+		b.WriteByte(p.b[p.i])
+	}
+	p.i++
+	return b.String()
+}
+
+func (p *tokParser) literal() []byte {
+	end := bytes.IndexByte(p.b[p.i:], '}')
+	n, _ := strconv.Atoi(strings.TrimSuffix(string(p.b[p.i+1:p.i+end]), "+"))
+	p.i += end + 3 // "}\r\n"
+	lit := p.b[p.i : p.i+n]
+	p.i += n
+	return lit
+}
+
+// atom reads up to a space or parenthesis; "[...]" is taken whole, so
+// BODY.PEEK[HEADER.FIELDS (FROM)] is one token.
+func (p *tokParser) atom() string {
+	start, depth := p.i, 0
+	for ; p.i < len(p.b); p.i++ {
+		c := p.b[p.i]
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n') {
+			break
+		}
+	}
+	return string(p.b[start:p.i])
+}
+
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func strs(v interface{}) []string {
+	l, ok := v.([]interface{})
+	if !ok {
+		return []string{str(v)}
+	}
+	var out []string
+	for _, x := range l {
+		out = append(out, str(x))
+	}
+	return out
+}
+
+/* command handling */
+
+type fakeSession struct {
+	s   *fakeServer
+	w   *bufio.Writer
+	sel string
+}
+
+func (c *fakeSession) untagged(format string, a ...interface{}) {
+	fmt.Fprintf(c.w, "* "+format+"\r\n", a...)
+}
+
+func (c *fakeSession) handle(tag string, args []interface{}) bool {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := strings.ToUpper(str(args[0]))
+	args = args[1:]
+	byUID := cmd == "UID"
+	if byUID {
+		cmd = strings.ToUpper(str(args[0]))
+		args = args[1:]
+		s.cmds = append(s.cmds, "UID "+cmd)
+	} else {
+		s.cmds = append(s.cmds, cmd)
+	}
+	status := "OK done"
+	switch cmd {
+	case "CAPABILITY":
+		c.untagged("CAPABILITY %s", strings.Join(s.caps, " "))
+	case "LOGIN", "NOOP":
+	case "LOGOUT":
+		c.untagged("BYE fake closing")
+		fmt.Fprintf(c.w, "%s OK bye\r\n", tag)
+		return false
+	case "LIST":
+		status = c.list(str(args[1]))
+	case "STATUS":
+		status = c.status(str(args[0]), strs(args[1]))
+	case "SELECT", "EXAMINE":
+		status = c.selectBox(str(args[0]), cmd == "EXAMINE")
+	case "CREATE":
+		if s.boxes[str(args[0])] != nil {
+			status = "NO [ALREADYEXISTS] exists"
+		} else {
+			s.addBox(str(args[0]))
+		}
+	case "SEARCH":
+		status = c.search(byUID, args)
+	case "FETCH":
+		status = c.fetch(byUID, str(args[0]), args[1])
+	case "STORE":
+		status = c.store(byUID, args)
+	case "EXPUNGE":
+		var set string
+		if byUID {
+			set = str(args[0])
+		}
+		status = c.expunge(set)
+	case "COPY", "MOVE":
+		status = c.copyTo(byUID, str(args[0]), str(args[1]), cmd == "MOVE")
+	case "APPEND":
+		status = c.appendMsgs(str(args[0]), args[1:])
+	default:
+		status = "BAD unknown command " + cmd
+	}
+	fmt.Fprintf(c.w, "%s %s\r\n", tag, status)
+	return true
+}
+
+func (c *fakeSession) has(cap string) bool {
+	for _, x := range c.s.caps {
+		if x == cap {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeSession) list(pattern string) string {
+	delim := strconv.Quote(c.s.delim)
+	if c.s.delim == "" {
+		delim = "NIL"
+	}
+	if pattern == "" {
+		c.untagged(`LIST (\Noselect) %s ""`, delim)
+		return "OK done"
+	}
+	for _, name := range c.s.order {
+		c.untagged("LIST () %s %s", delim, strconv.Quote(name))
+	}
+	return "OK done"
+}
+
+func (c *fakeSession) status(name string, items []string) string {
+	b := c.s.boxes[name]
+	if b == nil {
+		return "NO no such mailbox"
+	}
+	var out []string
+	for _, it := range items {
+		switch strings.ToUpper(it) {
+		case "MESSAGES":
+			out = append(out, fmt.Sprintf("MESSAGES %d", len(b.msgs)))
+		case "UIDNEXT":
+			out = append(out, fmt.Sprintf("UIDNEXT %d", b.next))
+		case "UIDVALIDITY":
+			out = append(out, fmt.Sprintf("UIDVALIDITY %d", b.validity))
+		case "UNSEEN":
+			n := 0
+			for _, m := range b.msgs {
+				if !hasFlag(m, imap.SeenFlag) {
+					n++
+				}
+			}
+			out = append(out, fmt.Sprintf("UNSEEN %d", n))
+		case "RECENT":
+			out = append(out, "RECENT 0")
+		}
+	}
+	c.untagged("STATUS %s (%s)", strconv.Quote(name), strings.Join(out, " "))
+	return "OK done"
+}
+
+func (c *fakeSession) selectBox(name string, readOnly bool) string {
+	c.sel = ""
+	b := c.s.boxes[name]
+	if b == nil || c.s.failSelect[name] {
+		return "NO cannot select " + name
+	}
+	c.sel = name
+	c.untagged(`FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	c.untagged("%d EXISTS", len(b.msgs))
+	c.untagged("0 RECENT")
+	c.untagged("OK [UIDVALIDITY %d] ok", b.validity)
+	c.untagged("OK [UIDNEXT %d] ok", b.next)
+	if readOnly {
+		return "OK [READ-ONLY] done"
+	}
+	return "OK [READ-WRITE] done"
+}
+
+func (c *fakeSession) box() *fakeBox { return c.s.boxes[c.sel] }
+
+// inSet reports whether n is in the sequence set spec; "*" is max.
+func inSet(spec string, n, max uint32) bool {
+	set, err := imap.ParseSeqSet(spec)
+	if err != nil {
+		return false
+	}
+	for _, r := range set.Set {
+		lo, hi := r.Start, r.Stop
+		if lo == 0 {
+			lo = max
+		}
+		if hi == 0 {
+			hi = max
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= n && n <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(m *fakeMsg, fl string) bool {
+	for _, f := range m.flags {
+		if strings.EqualFold(f, fl) {
+			return true
+		}
+	}
+	return false
+}
+
+func header(m *fakeMsg) mail.Header {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.body))
+	if err != nil {
+		return mail.Header{}
+	}
+	return msg.Header
+}
+
+// match evaluates the search key at keys[0] for message m at seq and
+// returns what is left of keys.
+func (c *fakeSession) match(m *fakeMsg, seq uint32, keys []interface{}) (bool, []interface{}) {
+	b := c.box()
+	if l, ok := keys[0].([]interface{}); ok {
+		return c.matchAll(m, seq, l), keys[1:]
+	}
+	k, rest := strings.ToUpper(str(keys[0])), keys[1:]
+	flagKey := map[string]string{"DELETED": imap.DeletedFlag, "SEEN": imap.SeenFlag,
+		"FLAGGED": imap.FlaggedFlag, "ANSWERED": imap.AnsweredFlag, "DRAFT": imap.DraftFlag}
+	if fl, ok := flagKey[k]; ok {
+		return hasFlag(m, fl), rest
+	}
+	if fl, ok := flagKey[strings.TrimPrefix(k, "UN")]; ok {
+		return !hasFlag(m, fl), rest
+	}
+	contains := func(s, sub string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(sub)) }
+	day := func(v interface{}) time.Time {
+		t, _ := time.Parse("2-Jan-2006", str(v))
+		return t
+	}
+	switch k {
+	case "ALL":
+		return true, rest
+	case "NOT":
+		ok, r := c.match(m, seq, rest)
+		return !ok, r
+	case "OR":
+		a, r := c.match(m, seq, rest)
+		o, r := c.match(m, seq, r)
+		return a || o, r
+	case "HEADER":
+		return contains(header(m).Get(str(rest[0])), str(rest[1])), rest[2:]
+	case "FROM", "TO", "CC", "SUBJECT":
+		return contains(header(m).Get(k), str(rest[0])), rest[1:]
+	case "BODY", "TEXT":
+		return contains(string(m.body), str(rest[0])), rest[1:]
+	case "BEFORE":
+		return m.date.Before(day(rest[0])), rest[1:]
+	case "SINCE":
+		return !m.date.Before(day(rest[0])), rest[1:]
+	case "LARGER":
+		n, _ := strconv.Atoi(str(rest[0]))
+		return len(m.body) > n, rest[1:]
+	case "SMALLER":
+		n, _ := strconv.Atoi(str(rest[0]))
+		return len(m.body) < n, rest[1:]
+	case "KEYWORD":
+		return hasFlag(m, str(rest[0])), rest[1:]
+	case "UNKEYWORD":
+		return !hasFlag(m, str(rest[0])), rest[1:]
+	case "UID":
+		return inSet(str(rest[0]), m.uid, b.next-1), rest[1:]
+	}
+	return inSet(k, seq, uint32(len(b.msgs))), rest
+}
+
+func (c *fakeSession) matchAll(m *fakeMsg, seq uint32, keys []interface{}) bool {
+	for len(keys) > 0 {
+		var ok bool
+		if ok, keys = c.match(m, seq, keys); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeSession) search(byUID bool, keys []interface{}) string {
+	b := c.box()
+	if b == nil {
+		return "BAD no mailbox selected"
+	}
+	if len(keys) > 1 && strings.EqualFold(str(keys[0]), "CHARSET") {
+		keys = keys[2:]
+	}
+	var hits []string
+	for i, m := range b.msgs {
+		if c.matchAll(m, uint32(i+1), keys) {
+			n := uint32(i + 1)
+			if byUID {
+				n = m.uid
+			}
+			hits = append(hits, strconv.FormatUint(uint64(n), 10))
+		}
+	}
+	c.untagged("%s", strings.TrimSpace("SEARCH "+strings.Join(hits, " ")))
+	return "OK done"
+}
+
+// selected returns the messages set names, with their sequence numbers.
+func (c *fakeSession) selected(byUID bool, set string) (msgs []*fakeMsg, seqs []uint32) {
+	b := c.box()
+	for i, m := range b.msgs {
+		if byUID && inSet(set, m.uid, b.next-1) || !byUID && inSet(set, uint32(i+1), uint32(len(b.msgs))) {
+			msgs = append(msgs, m)
+			seqs = append(seqs, uint32(i+1))
+		}
+	}
+	return
+}
+
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return strconv.Quote(s)
+}
+
+func envelope(m *fakeMsg) string {
+	h := header(m)
+	addrs := func(key string) string {
+		list, err := h.AddressList(key)
+		if err != nil || len(list) == 0 {
+			return "NIL"
+		}
+		var b strings.Builder
+		b.WriteString("(")
+		for _, a := range list {
+			at := strings.LastIndex(a.Address, "@")
+			fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(a.Name), strconv.Quote(a.Address[:at]), strconv.Quote(a.Address[at+1:]))
+		}
+		return b.String() + ")"
+	}
+	from := addrs("From")
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)", nstring(h.Get("Date")), nstring(h.Get("Subject")),
+		from, from, from, addrs("To"), addrs("Cc"), addrs("Bcc"), nstring(h.Get("In-Reply-To")), nstring(h.Get("Message-Id")))
+}
+
+// section returns the bytes of BODY[spec] of m.
+func section(m *fakeMsg, spec string) []byte {
+	hdr, text := m.body, []byte(nil)
+	if i := bytes.Index(m.body, []byte("\r\n\r\n")); i >= 0 {
+		hdr, text = m.body[:i+4], m.body[i+4:]
+	}
+	up := strings.ToUpper(spec)
+	switch {
+	case up == "":
+		return m.body
+	case up == "HEADER":
+		return hdr
+	case up == "TEXT":
+		return text
+	case strings.HasPrefix(up, "HEADER.FIELDS ("):
+		want := map[string]bool{}
+		for _, f := range strings.Fields(strings.Trim(up[len("HEADER.FIELDS "):], "()")) {
+			want[f] = true
+		}
+		var out []byte
+		keep := false
+		for _, line := range strings.SplitAfter(string(hdr), "\r\n") {
+			if line == "\r\n" || line == "" {
+				break
+			}
+			if line[0] != ' ' && line[0] != '\t' {
+				keep = want[strings.ToUpper(strings.TrimSpace(line[:strings.IndexByte(line+":", ':')]))]
+			}
+			if keep {
+				out = append(out, line...)
+			}
+		}
+		return append(out, "\r\n"...)
+	}
+	return nil
+}
+
+func (c *fakeSession) fetch(byUID bool, set string, items interface{}) string {
+	if c.box() == nil {
+		return "BAD no mailbox selected"
+	}
+	msgs, seqs := c.selected(byUID, set)
+	for i, m := range msgs {
+		var out bytes.Buffer
+		fields := []string{}
+		if byUID {
+			fields = append(fields, fmt.Sprintf("UID %d", m.uid))
+		}
+		var lits [][]byte
+		for _, it := range strs(items) {
+			up := strings.ToUpper(it)
+			switch {
+			case up == "UID":
+				if !byUID {
+					fields = append(fields, fmt.Sprintf("UID %d", m.uid))
+				}
+			case up == "FLAGS":
+				fields = append(fields, "FLAGS ("+strings.Join(m.flags, " ")+")")
+			case up == "INTERNALDATE":
+				fields = append(fields, `INTERNALDATE "`+m.date.Format("02-Jan-2006 15:04:05 -0700")+`"`)
+			case up == "RFC822.SIZE":
+				fields = append(fields, fmt.Sprintf("RFC822.SIZE %d", len(m.body)))
+			case up == "ENVELOPE":
+				fields = append(fields, "ENVELOPE "+envelope(m))
+			case up == "BODYSTRUCTURE" && c.s.structure != "":
+				fields = append(fields, "BODYSTRUCTURE "+c.s.structure)
+			case up == "BODYSTRUCTURE":
+				fields = append(fields, fmt.Sprintf(`BODYSTRUCTURE ("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" %d 1)`, len(section(m, "TEXT"))))
+			case up == "RFC822" || up == "RFC822.HEADER" || up == "RFC822.TEXT":
+				spec := strings.TrimPrefix(strings.TrimPrefix(up, "RFC822"), ".")
+				if up == "RFC822" && !hasFlag(m, imap.SeenFlag) {
+					m.flags = append(m.flags, imap.SeenFlag)
+				}
+				data := section(m, spec)
+				fields = append(fields, fmt.Sprintf("%s {%d}\r\n\x00", up, len(data)))
+				lits = append(lits, data)
+			case strings.HasPrefix(up, "BODY[") || strings.HasPrefix(up, "BODY.PEEK["):
+				spec := it[strings.IndexByte(it, '[')+1 : strings.LastIndexByte(it, ']')]
+				if !strings.HasPrefix(up, "BODY.PEEK[") && !hasFlag(m, imap.SeenFlag) {
+					m.flags = append(m.flags, imap.SeenFlag)
+				}
+				data := section(m, spec)
+				fields = append(fields, fmt.Sprintf("BODY[%s] {%d}\r\n\x00", spec, len(data)))
+				lits = append(lits, data)
+			default:
+				return "BAD unsupported fetch item " + it
+			}
+		}
+		// literals go where the \x00 placeholders are
+		line := fmt.Sprintf("* %d FETCH (%s)\r\n", seqs[i], strings.Join(fields, " "))
+		for _, part := range strings.Split(line, "\x00") {
+			out.WriteString(part)
+			if len(lits) > 0 {
+				out.Write(lits[0])
+				lits = lits[1:]
+			}
+		}
+		c.w.Write(out.Bytes())
+	}
+	return "OK done"
+}
+
+func (c *fakeSession) store(byUID bool, args []interface{}) string {
+	if c.box() == nil {
+		return "BAD no mailbox selected"
+	}
+	if hook := c.s.beforeStore; hook != nil {
+		c.s.beforeStore = nil
+		hook(c.s)
+	}
+	op := strings.ToUpper(str(args[1]))
+	flags := strs(args[2])
+	msgs, seqs := c.selected(byUID, str(args[0]))
+	for i, m := range msgs {
+		switch strings.TrimSuffix(op, ".SILENT") {
+		case "+FLAGS":
+			for _, f := range flags {
+				if !hasFlag(m, f) {
+					m.flags = append(m.flags, f)
+				}
+			}
+		case "-FLAGS":
+			var kept []string
+			for _, f := range m.flags {
+				drop := false
+				for _, g := range flags {
+					drop = drop || strings.EqualFold(f, g)
+				}
+				if !drop {
+					kept = append(kept, f)
+				}
+			}
+			m.flags = kept
+		case "FLAGS":
+			m.flags = append([]string(nil), flags...)
+		}
+		if !strings.HasSuffix(op, ".SILENT") {
+			c.untagged("%d FETCH (UID %d FLAGS (%s))", seqs[i], m.uid, strings.Join(m.flags, " "))
+		}
+	}
+	return "OK done"
+}
+
+// expunge removes the \Deleted messages, only those in the UID set spec
+// unless it is empty.
+func (c *fakeSession) expunge(spec string) string {
+	b := c.box()
+	if b == nil {
+		return "BAD no mailbox selected"
+	}
+	for i := 0; i < len(b.msgs); {
+		m := b.msgs[i]
+		if hasFlag(m, imap.DeletedFlag) && (spec == "" || inSet(spec, m.uid, b.next-1)) {
+			b.msgs = append(b.msgs[:i], b.msgs[i+1:]...)
+			c.untagged("%d EXPUNGE", i+1)
+			continue
+		}
+		i++
+	}
+	return "OK done"
+}
+
+func (c *fakeSession) copyTo(byUID bool, set, dest string, move bool) string {
+	b, to := c.box(), c.s.boxes[dest]
+	if b == nil {
+		return "BAD no mailbox selected"
+	}
+	if to == nil {
+		return "NO [TRYCREATE] no such mailbox"
+	}
+	msgs, _ := c.selected(byUID, set)
+	for _, m := range msgs {
+		to.msgs = append(to.msgs, &fakeMsg{to.next, append([]string(nil), m.flags...), m.date, m.body})
+		to.next++
+		if move {
+			m.flags = append(m.flags, imap.DeletedFlag)
+		}
+	}
+	if move {
+		for i := 0; i < len(b.msgs); {
+			if hasFlag(b.msgs[i], imap.DeletedFlag) && containsMsg(msgs, b.msgs[i]) {
+				b.msgs = append(b.msgs[:i], b.msgs[i+1:]...)
+				c.untagged("%d EXPUNGE", i+1)
+				continue
+			}
+			i++
+		}
+	}
+	return "OK done"
+}
+
+func containsMsg(list []*fakeMsg, m *fakeMsg) bool {
+	for _, x := range list {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMsgs handles APPEND, with several messages under MULTIAPPEND.
+func (c *fakeSession) appendMsgs(name string, args []interface{}) string {
+	b := c.s.boxes[name]
+	if b == nil {
+		return "NO [TRYCREATE] no such mailbox"
+	}
+	var uids []string
+	for len(args) > 0 {
+		m := &fakeMsg{date: time.Now()}
+		if l, ok := args[0].([]interface{}); ok {
+			m.flags = strs(l)
+			args = args[1:]
+		}
+		if s, ok := args[0].(string); ok {
+			t, err := time.Parse("_2-Jan-2006 15:04:05 -0700", s)
+			if err != nil {
+				return "BAD bad date " + s
+			}
+			m.date = t
+			args = args[1:]
+		}
+		lit, ok := args[0].([]byte)
+		if !ok {
+			return "BAD message literal expected"
+		}
+		m.body = append([]byte(nil), lit...)
+		args = args[1:]
+		if len(uids) > 0 && !c.has("MULTIAPPEND") {
+			return "BAD one message per APPEND"
+		}
+		m.uid = b.next
+		b.next++
+		b.msgs = append(b.msgs, m)
+		uids = append(uids, strconv.FormatUint(uint64(m.uid), 10))
+	}
+	if c.has("UIDPLUS") {
+		return fmt.Sprintf("OK [APPENDUID %d %s] done", b.validity, strings.Join(uids, ","))
+	}
+	return "OK done"
+}
+
+/* ── test helpers ─────────────────────────────────────── */
+
+// setFlags sets command-line flags for one test and restores them after.
+func setFlags(t *testing.T, kv ...string) {
+	t.Helper()
+	for i := 0; i < len(kv); i += 2 {
+		f := flag.Lookup(kv[i])
+		if f == nil {
+			t.Fatalf("no flag -%s", kv[i])
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(kv[i+1]); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+}
+
+// rfc822 builds a small message.
+func rfc822(from, subject, text string) string {
+	return "From: " + from + "\r\nTo: me@example.com\r\nSubject: " + subject +
+		"\r\nDate: Mon, 02 Jan 2023 15:04:05 +0000\r\nMessage-Id: <" + strings.ReplaceAll(subject, " ", ".") + "@example.com>\r\n\r\n" + text + "\r\n"
+}
+
+/* ── folder scan ──────────────────────────────────────── */
+
+// TestScanFolderSelectFails has SELECT of the second folder fail while
+// INBOX is still selected: nothing may be reported from INBOX instead.
+func TestScanFolderSelectFails(t *testing.T) {
+	s := newFakeServer(t)
+	s.add("INBOX", 0, nil, time.Now(), rfc822("a@example.com", "one", "x"))
+	s.add("Broken", 0, nil, time.Now(), rfc822("b@example.com", "two", "x"))
+	s.failSelect["Broken"] = true
+	cli := s.login(t)
+
+	n := 0
+	if err := scanFolder(cli, "INBOX", true, false, nil, func(*imap.Message) { n++ }); err != nil || n != 1 {
+		t.Fatalf("INBOX scan: %d msgs, %v; want 1", n, err)
+	}
+	n = 0
+	s.mu.Lock()
+	mark := len(s.cmds)
+	s.mu.Unlock()
+	if err := scanFolder(cli, "Broken", true, false, nil, func(*imap.Message) { n++ }); err == nil {
+		t.Error("scan of an unselectable folder returned no error")
+	}
+	if n != 0 {
+		t.Errorf("scan of an unselectable folder reported %d msgs", n)
+	}
+	s.mu.Lock()
+	after := s.cmds[mark:]
+	s.mu.Unlock()
+	if len(after) != 1 || after[0] != "SELECT" {
+		t.Errorf("commands for the unselectable folder: %v, want SELECT only", after)
+	}
+}
+
+// TestPickHeaders times ENVELOPE against header fields on the first big
+// enough folder only; -fast skips the probe.
+func TestPickHeaders(t *testing.T) {
+	reset := func() {
+		scanPick.Lock()
+		scanPick.done, scanPick.headers = false, false
+		scanPick.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	setFlags(t, "quiet", "true")
+	s := newFakeServer(t)
+	for i := 0; i < probeMsgs; i++ {
+		s.add("INBOX", 0, nil, time.Now(), rfc822("a@example.com", fmt.Sprint("big ", i), "x"))
+	}
+	s.add("Small", 0, nil, time.Now(), rfc822("b@example.com", "small", "x"))
+	cli := s.login(t)
+
+	n := 0
+	scan := func(folder string) int {
+		t.Helper()
+		before := s.count("UID FETCH")
+		if err := scanFolder(cli, folder, true, false, nil, func(*imap.Message) { n++ }); err != nil {
+			t.Fatal(err)
+		}
+		return s.count("UID FETCH") - before
+	}
+	if f := scan("Small"); f != 1 {
+		t.Errorf("folder under probeMsgs: %d FETCHes, want no probe", f)
+	}
+	if f := scan("INBOX"); f != 3 {
+		t.Errorf("first big folder: %d FETCHes, want 2 for the probe and the scan", f)
+	}
+	if f := scan("INBOX"); f != 1 {
+		t.Errorf("second scan: %d FETCHes, want the probe not repeated", f)
+	}
+	if n != 2*probeMsgs+1 {
+		t.Errorf("%d msgs reported, want %d", n, 2*probeMsgs+1)
+	}
+
+	reset()
+	setFlags(t, "fast", "true")
+	if f := scan("INBOX"); f != 1 {
+		t.Errorf("-fast: %d FETCHes, want no probe", f)
+	}
+}
+
+/* ── matching ─────────────────────────────────────────── */
+
+func TestContainsFold(t *testing.T) {
+	const nfc, nfd = "Caf\u00e9", "Cafe\u0301"
+	for _, tc := range []struct {
+		s, sub string
+		want   bool
+	}{
+		{"Re: " + nfc + " menu", nfd, true},
+		{"Re: " + nfd + " menu", nfc, true},
+		{"Re: " + nfd + " menu", "CAFÉ", true},
+		{"Re: " + nfc + " menu", "cafe", false},
+		{"Invoice", "invoice", true},
+		{"Invoice", "receipt", false},
+	} {
+		if got := containsFold(tc.s, tc.sub); got != tc.want {
+			t.Errorf("containsFold(%+q, %+q) = %v, want %v", tc.s, tc.sub, got, tc.want)
+		}
+	}
+}
+
+/* ── backup and restore ───────────────────────────────── */
+
+// writeArchive builds a .tar.gz from hand-made entries.
+func writeArchive(t *testing.T, entries []*tar.Header, bodies []string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for i, h := range entries {
+		h.Size, h.Mode = int64(len(bodies[i])), 0600
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(bodies[i]))
+	}
+	tw.Close()
+	gw.Close()
+	tgz := t.TempDir() + "/in.tar.gz"
+	if err := os.WriteFile(tgz, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tgz
+}
+
+func TestRestoreSource(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	body := []string{rfc822("a@example.com", "one", "1"), rfc822("b@example.com", "two", "2"), rfc822("c@example.com", "three", "3")}
+	seen := &imap.Message{Uid: 1, Flags: []string{imap.SeenFlag}, InternalDate: time.Unix(1690000000, 0)}
+	for _, tc := range []struct {
+		layout  string
+		entries []*tar.Header
+		want    []string // folder|unix date, by body
+	}{
+		{"native", []*tar.Header{
+			entryHeader("INBOX", ".", 5, seen, nil),
+			entryHeader("Sent", ".", 5, &imap.Message{Uid: 2, InternalDate: time.Unix(1700000000, 0)}, nil),
+			entryHeader("Work.Acme", ".", 5, &imap.Message{Uid: 3, InternalDate: time.Unix(1700000500, 0)}, nil),
+		}, []string{"INBOX|1690000000", "Sent|1700000000", "Work.Acme|1700000500"}},
+		{"maildir", []*tar.Header{
+			{Name: "Maildir/cur/1690000000.M1P1.host:2,S"},
+			{Name: "Maildir/.Sent/cur/1700000000.M1P2.host:2,S"},
+			{Name: "Maildir/.Work.Acme/new/1700000500.M1P3.host", ModTime: time.Unix(1, 0)},
+		}, []string{"INBOX|1690000000", "Sent|1700000000", "Work.Acme|1700000500"}},
+	} {
+		t.Run(tc.layout, func(t *testing.T) {
+			setFlags(t, "restore-source", tc.layout)
+			s := newFakeServer(t, "UIDPLUS")
+			s.delim = "."
+			tgz := writeArchive(t, tc.entries, body)
+			if err := restoreAll(s.login(t), tgz); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, b := range body {
+				got = append(got, "missing "+strconv.Itoa(i))
+				for name, box := range s.boxes {
+					for _, m := range box.msgs {
+						if string(m.body) == b {
+							got[i] = fmt.Sprintf("%s|%d", name, m.date.Unix())
+						}
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("restored as %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// mailbox seeds a server with a few folders of mail carrying system
+// flags, a keyword and fixed dates.
+func mailbox(t *testing.T) *fakeServer {
+	s := newFakeServer(t, "UIDPLUS")
+	day := func(d int) time.Time { return time.Date(2023, 3, d, 9, 30, 0, 0, time.FixedZone("", 2*3600)) }
+	s.add("INBOX", 0, []string{imap.SeenFlag}, day(1), rfc822("a@example.com", "read", "one"))
+	s.add("INBOX", 0, []string{imap.FlaggedFlag, "$Label1"}, day(2), rfc822("b@example.com", "starred", "two"))
+	s.add("INBOX", 0, nil, day(3), rfc822("c@example.com", "unread", "three"))
+	s.add("Work/Clients", 0, []string{imap.SeenFlag, imap.AnsweredFlag}, day(4), rfc822("d@example.com", "client", "four"))
+	s.add("Work/Clients", 0, []string{imap.SeenFlag}, day(5), rfc822("e@example.com", "client two", "five"))
+	return s
+}
+
+// contents describes every message of every folder as "folder|flags|date|body",
+// sorted, with \Recent left out. Flags are compared lower-cased: they are
+// case-insensitive and go-imap lower-cases keywords it fetches.
+func (s *fakeServer) contents() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for name, b := range s.boxes {
+		for _, m := range b.msgs {
+			var fl []string
+			for _, f := range m.flags {
+				if f != imap.RecentFlag {
+					fl = append(fl, strings.ToLower(f))
+				}
+			}
+			sort.Strings(fl)
+			out = append(out, fmt.Sprintf("%s|%s|%s|%s", name, strings.Join(fl, " "), m.date.UTC().Format(time.RFC3339), m.body))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// archive backs s up into a fresh .tar.gz and returns its path.
+func archive(t *testing.T, s *fakeServer) string {
+	t.Helper()
+	tgz := t.TempDir() + "/backup.tar.gz"
+	if err := backupAll(s.login(t), s.addr(), tgz); err != nil {
+		t.Fatal(err)
+	}
+	return tgz
+}
+
+// TestRestoreBatch restores one archive with an APPEND per message and
+// with MULTIAPPEND batches; both must leave the same mailbox.
+func TestRestoreBatch(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	src := mailbox(t)
+	tgz := archive(t, src)
+
+	restore := func(batch string) *fakeServer {
+		setFlags(t, "restore-batch", batch)
+		dst := newFakeServer(t, "UIDPLUS", "MULTIAPPEND")
+		if err := restoreAll(dst.login(t), tgz); err != nil {
+			t.Fatal(err)
+		}
+		return dst
+	}
+	single, batched := restore("1"), restore("3")
+	if got, want := batched.contents(), single.contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("batched restore differs\n got: %q\nwant: %q", got, want)
+	}
+	if got, want := single.contents(), src.contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored mailbox differs\n got: %q\nwant: %q", got, want)
+	}
+	// 3 msgs in INBOX and 2 in Work/Clients: one APPEND per folder
+	if n, m := single.count("APPEND"), batched.count("APPEND"); n != 5 || m != 2 {
+		t.Errorf("APPEND commands: %d single, %d batched; want 5 and 2", n, m)
+	}
+}
+
+/* ── run metrics ──────────────────────────────────────── */
+
+func TestWriteMetrics(t *testing.T) {
+	old := runMetrics
+	t.Cleanup(func() { runMetrics = old })
+	runMetrics.scanned, runMetrics.deleted, runMetrics.errors = 1200, 35, 2
+
+	path := t.TempDir() + "/imap.prom"
+	end := time.Unix(1700000000, 0)
+	if err := writeMetrics(path, end.Add(-90*time.Second), end); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		f := strings.Fields(line)
+		got[f[0]] = f[1]
+	}
+	want := map[string]string{
+		"imap_tool_messages_scanned":           "1200",
+		"imap_tool_messages_deleted":           "35",
+		"imap_tool_errors":                     "2",
+		"imap_tool_last_run_duration_seconds":  "90",
+		"imap_tool_last_run_timestamp_seconds": "1700000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+	if !strings.Contains(string(b), "# TYPE imap_tool_errors gauge\n") {
+		t.Errorf("no TYPE line for imap_tool_errors:\n%s", b)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("%s.tmp left behind", path)
+	}
+}
+
+/* ── charsets ─────────────────────────────────────────── */
+
+func TestBestDecode(t *testing.T) {
+	enc := func(e encoding.Encoding, s string) []byte {
+		b, err := e.NewEncoder().Bytes([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	const ru = "Привет, как дела? Счёт за октябрь"
+	const zh = "你好，这是本月的账单"
+	for _, tc := range []struct {
+		name     string
+		raw      []byte
+		declared string
+		want     string
+	}{
+		{"cp1251 labelled koi8-r", enc(charmap.Windows1251, ru), "koi8-r", ru},
+		{"koi8-r labelled windows-1251", enc(charmap.KOI8R, ru), "windows-1251", ru},
+		{"koi8-r labelled right", enc(charmap.KOI8R, ru), "koi8-r", ru},
+		{"cp1251 labelled utf-8", enc(charmap.Windows1251, ru), "utf-8", ru},
+		{"gbk labelled iso-8859-1", enc(simplifiedchinese.GBK, zh), "iso-8859-1", zh},
+		{"ascii", []byte("Invoice #42"), "koi8-r", "Invoice #42"},
+		{"utf-8", []byte(ru), "windows-1251", ru},
+	} {
+		if got := bestDecode(tc.raw, tc.declared); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestWipeTargetsUIDs scans a mailbox whose UIDs have gaps, deletes the
+// middle sender's bucket, and has another client expunge a message
+// between the scan and the delete, shifting every sequence number.
+func TestWipeTargetsUIDs(t *testing.T) {
+	for _, caps := range [][]string{{"UIDPLUS"}, nil} {
+		t.Run(fmt.Sprint(caps), func(t *testing.T) {
+			setFlags(t, "quiet", "true", "yes", "true")
+			s := newFakeServer(t, caps...)
+			when := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+			s.add("INBOX", 3, nil, when, rfc822("a@example.com", "one", "x"))
+			s.add("INBOX", 7, nil, when, rfc822("b@example.com", "two", "x"))
+			s.add("INBOX", 9, nil, when, rfc822("b@example.com", "three", "x"))
+			s.add("INBOX", 15, nil, when, rfc822("c@example.com", "four", "x"))
+			s.add("INBOX", 20, nil, when, rfc822("a@example.com", "five", "x"))
+			cli := s.login(t)
+
+			buckets := map[string]*bucket{}
+			err := scanFolder(cli, "INBOX", true, false, nil, func(m *imap.Message) {
+				key := classify(m, "from")
+				if buckets[key] == nil {
+					buckets[key] = &bucket{Key: key, ByFolder: map[string][]uint32{}}
+				}
+				buckets[key].add("INBOX", m.Uid, int64(m.Size))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mid := buckets["b@example.com"]
+			if mid == nil || !reflect.DeepEqual(mid.ByFolder["INBOX"], []uint32{7, 9}) {
+				t.Fatalf("b@example.com bucket = %+v, want UIDs 7 and 9", mid)
+			}
+
+			s.beforeStore = func(s *fakeServer) { // another client removes UID 3
+				b := s.boxes["INBOX"]
+				b.msgs = b.msgs[1:]
+			}
+			wipe(cli, mid.ByFolder)
+			if got, want := s.uids("INBOX"), []uint32{15, 20}; !reflect.DeepEqual(got, want) {
+				t.Errorf("INBOX after the delete holds %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+/* ── credentials ──────────────────────────────────────── */
+
+func TestResolvePassword(t *testing.T) {
+	for _, tc := range []struct {
+		flag, env, want string
+	}{
+		{"", "from-env", "from-env"},
+		{"", "", ""},
+		{"explicit", "from-env", "explicit"},
+		{"explicit", "", "explicit"},
+	} {
+		setFlags(t, "password", tc.flag)
+		t.Setenv("IMAP_PASSWORD", tc.env)
+		if tc.env == "" {
+			os.Unsetenv("IMAP_PASSWORD") // Setenv still restores it
+		}
+		got, err := resolvePassword()
+		if err != nil || got != tc.want {
+			t.Errorf("-password %q, $IMAP_PASSWORD %q: got %q, %v; want %q", tc.flag, tc.env, got, err, tc.want)
+		}
+	}
+}
+
+/* ── UID plumbing ─────────────────────────────────────── */
+
+func TestSplitSet(t *testing.T) {
+	for _, tc := range []struct {
+		set  string
+		n    int
+		want []string
+	}{
+		{"1:10", 3, []string{"1:3", "4:6", "7:9", "10"}},
+		{"1,3,5:6", 2, []string{"1,3", "5:6"}},
+		{"7,9,15", 5, []string{"7,9,15"}},
+		{"4:*", 2, []string{"4:*"}}, // can't be counted, sent whole
+		{"4294967294:4294967295", 1, []string{"4294967294", "4294967295"}},
+	} {
+		set, err := imap.ParseSeqSet(tc.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range splitSet(set, tc.n) {
+			got = append(got, s.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitSet(%s, %d) = %v, want %v", tc.set, tc.n, got, tc.want)
+		}
+	}
+}
+
+/* ── age specs ────────────────────────────────────────── */
+
+func TestParseAgeSpec(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		in   string
+		want time.Time // zero: relative, checked against ago
+		ago  time.Duration
+		bad  bool
+	}{
+		{in: "2024-01-31T10:00:00+02:00", want: time.Date(2024, 1, 31, 8, 0, 0, 0, time.UTC)},
+		{in: "2024-01-31", want: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{in: " 2024-01-31 ", want: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{in: "90d", ago: 90 * 24 * time.Hour},
+		{in: "12w", ago: 12 * 7 * 24 * time.Hour},
+		{in: "36h", ago: 36 * time.Hour},
+		{in: "0d", ago: 0},
+		{in: "abc", bad: true},
+		{in: "-5d", bad: true},
+		{in: "5x", bad: true},
+		{in: "d", bad: true},
+		{in: "", bad: true},
+	} {
+		got, err := parseAgeSpec(tc.in)
+		switch {
+		case tc.bad:
+			if err == nil {
+				t.Errorf("parseAgeSpec(%q) = %v, want an error", tc.in, got)
+			}
+		case err != nil:
+			t.Errorf("parseAgeSpec(%q): %v", tc.in, err)
+		case !tc.want.IsZero():
+			if !got.Equal(tc.want) {
+				t.Errorf("parseAgeSpec(%q) = %v, want %v", tc.in, got, tc.want)
+			}
+		default:
+			if d := now.Add(-tc.ago).Sub(got); d < -time.Minute || d > time.Minute {
+				t.Errorf("parseAgeSpec(%q) = %v, want about %v ago", tc.in, got, tc.ago)
+			}
+		}
+	}
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	src := mailbox(t)
+	tgz := archive(t, src)
+
+	dst := newFakeServer(t, "UIDPLUS")
+	if err := restoreAll(dst.login(t), tgz); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dst.contents(), src.contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored mailbox differs\n got: %q\nwant: %q", got, want)
+	}
+}
+
+// TestBackupAfterReset rebuilds INBOX under a new UIDVALIDITY, the same
+// UIDs reissued, between two runs into one archive: the old entries must
+// go, or a restore brings back every message twice.
+func TestBackupAfterReset(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	src := mailbox(t)
+	tgz := archive(t, src)
+
+	src.mu.Lock()
+	src.boxes["INBOX"].validity += 100
+	src.mu.Unlock()
+	if err := backupAll(src.login(t), src.addr(), tgz); err != nil {
+		t.Fatal(err)
+	}
+	dst := newFakeServer(t, "UIDPLUS")
+	if err := restoreAll(dst.login(t), tgz); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dst.contents(), src.contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored mailbox differs\n got: %q\nwant: %q", got, want)
+	}
+}
+
+// TestRestoreCollision restores "read" and "starred" into a folder that
+// already has the very same "read" and a "starred" of equal size but
+// other bytes: only that one is a collision for the policy to settle.
+func TestRestoreCollision(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	read, starred := rfc822("a@example.com", "read", "one"), rfc822("b@example.com", "starred", "two")
+	other := rfc822("b@example.com", "starred", "owt")
+	src := newFakeServer(t, "UIDPLUS")
+	src.add("INBOX", 0, nil, time.Now(), read)
+	src.add("INBOX", 0, nil, time.Now(), starred)
+	tgz := archive(t, src)
+
+	for _, tc := range []struct {
+		policy string
+		want   []string
+	}{
+		{"skip", []string{read, other}},
+		{"keep-both", []string{read, other, starred}},
+		{"replace", []string{read, starred}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			setFlags(t, "restore-collision", tc.policy)
+			dst := newFakeServer(t, "UIDPLUS")
+			dst.add("INBOX", 0, nil, time.Now(), read)
+			dst.add("INBOX", 0, nil, time.Now(), other)
+			if err := restoreAll(dst.login(t), tgz); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			dst.mu.Lock()
+			for _, m := range dst.boxes["INBOX"].msgs {
+				got = append(got, string(m.body))
+			}
+			dst.mu.Unlock()
+			sort.Strings(got)
+			sort.Strings(tc.want)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("INBOX holds\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+/* ── attachment stripping ────────────────────────────── */
+
+// withPDF builds a message with a text part and a base64 application/pdf
+// attachment of size decoded bytes.
+func withPDF(subject string, size int) (msg string, pdf []byte) {
+	pdf = bytes.Repeat([]byte("%PDF"), size/4)
+	b64 := base64.StdEncoding.EncodeToString(pdf)
+	var lines []string
+	for len(b64) > 76 {
+		lines, b64 = append(lines, b64[:76]), b64[76:]
+	}
+	lines = append(lines, b64)
+	msg = "From: a@example.com\r\nTo: me@example.com\r\nSubject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"XX\"\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--XX\r\nContent-Type: application/pdf; name=\"report.pdf\"\r\nContent-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" + strings.Join(lines, "\r\n") + "\r\n--XX--\r\n"
+	return msg, pdf
+}
+
+func TestStripMessage(t *testing.T) {
+	old := stripMin
+	stripMin = 1000
+	t.Cleanup(func() { stripMin = old })
+	dir := t.TempDir()
+
+	raw, pdf := withPDF("report", 4000)
+	out, saved, err := stripMessage([]byte(raw), dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Name != "report.pdf" || saved[0].Size != int64(len(pdf)) {
+		t.Fatalf("saved %+v, want report.pdf of %d bytes", saved, len(pdf))
+	}
+	if got, err := os.ReadFile(saved[0].Path); err != nil || !bytes.Equal(got, pdf) {
+		t.Errorf("%s does not hold the decoded attachment (%v)", saved[0].Path, err)
+	}
+	head := raw[:strings.Index(raw, "--XX\r\nContent-Type: application/pdf")]
+	if !strings.HasPrefix(string(out), head) {
+		t.Errorf("headers and text part not kept byte for byte:\n%s", out)
+	}
+	if !strings.Contains(string(out), "[attachment removed: report.pdf") || !strings.HasSuffix(string(out), "\r\n--XX--\r\n") {
+		t.Errorf("no stub in place of the attachment:\n%s", out)
+	}
+
+	small, _ := withPDF("small", 400)
+	if out, saved, err := stripMessage([]byte(small), dir, 8); err != nil || len(saved) != 0 || string(out) != small {
+		t.Errorf("attachment under -min-size: %d saved, changed %v, %v", len(saved), string(out) != small, err)
+	}
+}
+
+// TestStripAttachments replaces a flagged and an unflagged message: each
+// stripped copy is appended before its original goes, and -keep-flagged
+// and -move, meant for deletes, leave the originals alone.
+func TestStripAttachments(t *testing.T) {
+	setFlags(t, "quiet", "true", "yes", "true", "keep-flagged", "true", "move", "Trash", "export", t.TempDir(), "min-size", "1KB")
+	old := stripMin
+	stripMin = 1024
+	t.Cleanup(func() { stripMin = old })
+	s := newFakeServer(t, "UIDPLUS")
+	s.structure = `(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 14 1)("APPLICATION" "PDF" ("NAME" "report.pdf") NIL NIL "BASE64" 5500) "MIXED")`
+	one, _ := withPDF("one", 4000)
+	two, _ := withPDF("two", 4000)
+	s.add("INBOX", 0, []string{imap.FlaggedFlag}, time.Now(), one)
+	s.add("INBOX", 0, []string{imap.SeenFlag}, time.Now(), two)
+	s.addBox("Trash")
+
+	if err := stripAttachments(s.login(t), map[string][]uint32{"INBOX": {1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.uids("INBOX"); !reflect.DeepEqual(got, []uint32{3, 4}) {
+		t.Errorf("INBOX holds UIDs %v, want only the stripped copies 3 and 4", got)
+	}
+	if got := s.uids("Trash"); len(got) != 0 {
+		t.Errorf("originals moved to Trash: %v", got)
+	}
+	s.mu.Lock()
+	var order []string
+	for _, c := range s.cmds {
+		if c == "APPEND" || c == "UID STORE" || c == "UID EXPUNGE" {
+			order = append(order, c)
+		}
+	}
+	for _, m := range s.boxes["INBOX"].msgs {
+		if strings.Contains(string(m.body), "Content-Type: application/pdf") {
+			t.Errorf("uid %d still carries the attachment", m.uid)
+		}
+	}
+	s.mu.Unlock()
+	want := []string{"APPEND", "UID STORE", "UID EXPUNGE", "APPEND", "UID STORE", "UID EXPUNGE"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("commands %v, want %v", order, want)
+	}
+}
+
+/* ── duplicates ───────────────────────────────────────── */
+
+// answer feeds line to the next prompt, as if typed.
+func answer(t *testing.T, line string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(line + "\n")
+	w.Close()
+	old := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = old
+		r.Close()
+	})
+}
+
+// TestDedupMove moves the extra copy to the review folder with its flags
+// and date, and a second run does not count the moved copy again.
+func TestDedupMove(t *testing.T) {
+	setFlags(t, "dedup", "true", "dedup-move", "Duplicates", "move", "Duplicates") // main copies -dedup-move into -move
+	s := newFakeServer(t, "UIDPLUS", "MOVE")
+	when := time.Date(2023, 5, 1, 8, 0, 0, 0, time.UTC)
+	msg := rfc822("a@example.com", "report", "x")
+	s.add("INBOX", 0, []string{imap.SeenFlag}, when, msg)
+	s.add("INBOX", 0, nil, when, rfc822("b@example.com", "single", "y"))
+	s.add("Archive", 0, []string{imap.SeenFlag, imap.FlaggedFlag}, when, msg)
+	s.add("Duplicates", 0, nil, when, rfc822("c@example.com", "old", "z"))
+	cli := s.login(t)
+
+	for run := 1; run <= 2; run++ {
+		answer(t, "y")
+		if err := dedup(cli); err != nil {
+			t.Fatal(err)
+		}
+		if got := [3]int{len(s.uids("INBOX")), len(s.uids("Archive")), len(s.uids("Duplicates"))}; got != [3]int{2, 0, 2} {
+			t.Fatalf("run %d: INBOX, Archive, Duplicates hold %v msgs, want [2 0 2]", run, got)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := s.boxes["Duplicates"].msgs[1]
+	if string(moved.body) != msg || !hasFlag(moved, imap.FlaggedFlag) || !moved.date.Equal(when) {
+		t.Errorf("moved copy: flags %v, date %v; want the Archive copy with \\Flagged and %v", moved.flags, moved.date, when)
+	}
+}
+
+// TestDedupKey finds a resent copy (new Message-Id, same subject a minute
+// later, same text) by subject+date and by body-hash, but not by
+// message-id.
+func TestDedupKey(t *testing.T) {
+	msg := func(id, subject, text string) string {
+		return "From: a@example.com\r\nSubject: " + subject + "\r\nMessage-Id: <" + id + "@example.com>\r\n\r\n" + text + "\r\n"
+	}
+	at := time.Date(2023, 5, 1, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		key  string
+		left int
+	}{
+		{"message-id", 4},
+		{"subject+date", 3},
+		{"body-hash", 3},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			setFlags(t, "dedup", "true", "dedup-key", tc.key)
+			s := newFakeServer(t, "UIDPLUS")
+			s.add("INBOX", 0, nil, at, msg("r1", "Weekly report", "same text"))
+			s.add("INBOX", 0, nil, at, msg("r4", "Different", "x"))
+			s.add("Archive", 0, nil, at.Add(time.Minute), msg("r2", "  weekly   REPORT", "same text"))
+			s.add("Archive", 0, nil, at.Add(time.Hour), msg("r3", "Weekly report", "other text"))
+			answer(t, "y")
+			if err := dedup(s.login(t)); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(s.uids("INBOX")) + len(s.uids("Archive")); n != tc.left {
+				t.Errorf("%d msgs left, want %d", n, tc.left)
+			}
+			if len(s.uids("INBOX")) != 2 {
+				t.Errorf("INBOX holds %v, want both originals", s.uids("INBOX"))
+			}
+		})
+	}
+}
+
+/* ── server discovery ─────────────────────────────────── */
+
+func TestGuessServerSRV(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	for _, tc := range []struct {
+		name     string
+		recs     map[string][]*net.SRV // by service
+		addr     string
+		implicit bool
+	}{
+		{"imaps preferred", map[string][]*net.SRV{
+			"imaps": {{Target: "imap.example.com.", Port: 993}},
+			"imap":  {{Target: "mx.example.com.", Port: 143}},
+		}, "imap.example.com:993", true},
+		{"imap only", map[string][]*net.SRV{
+			"imap": {{Target: "mx.example.com.", Port: 143}},
+		}, "mx.example.com:143", false},
+		{"imaps not offered", map[string][]*net.SRV{
+			"imaps": {{Target: ".", Port: 0}},
+			"imap":  {{Target: "mx.example.com.", Port: 1143}},
+		}, "mx.example.com:1143", false},
+		{"first usable record", map[string][]*net.SRV{
+			"imaps": {{Target: ".", Port: 993}, {Target: "b.example.com.", Port: 993}},
+		}, "b.example.com:993", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			old := lookupSRV
+			t.Cleanup(func() { lookupSRV = old })
+			lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+				if proto != "tcp" || name != "example.com" {
+					t.Errorf("SRV lookup of %s/%s/%s", service, proto, name)
+				}
+				if recs, ok := tc.recs[service]; ok {
+					return "", recs, nil
+				}
+				return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			addr, implicit := guessServer("me@example.com")
+			if addr != tc.addr || implicit != tc.implicit {
+				t.Errorf("guessServer = %s (implicit %v), want %s (implicit %v)", addr, implicit, tc.addr, tc.implicit)
+			}
+		})
+	}
+}
+
+/* ── archive layout ───────────────────────────────────── */
+
+/* ── archive layout ───────────────────────────────────── */
+
+// TestEntryRoundTrip writes entries through a real tar stream and checks
+// that the folder levels come back as the server had them.
+func TestEntryRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		folder, delim, name string
+		segs                []string
+	}{
+		{"Work.Clients.Acme", ".", "Work/Clients/Acme/42.eml", []string{"Work", "Clients", "Acme"}},
+		{"Work.A/B 100%", ".", "Work/A%2FB 100%25/42.eml", []string{"Work", "A/B 100%"}},
+		{"Work/Clients", "/", "Work/Clients/42.eml", []string{"Work", "Clients"}},
+		{"a/b", "", "a%2Fb/42.eml", []string{"a/b"}},
+	} {
+		m := &imap.Message{Uid: 42, Flags: []string{imap.SeenFlag}, InternalDate: time.Unix(1700000000, 0)}
+		h := entryHeader(tc.folder, tc.delim, 7, m, []byte("x"))
+		if h.Name != entryName(tc.folder, tc.delim, 42) || h.Name != tc.name {
+			t.Errorf("%q on %q is stored as %q, want %q", tc.folder, tc.delim, h.Name, tc.name)
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("x"))
+		tw.Close()
+		back, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs := entryFolder(back)
+		if !reflect.DeepEqual(segs, tc.segs) {
+			t.Errorf("%q on %q reads back as %q, want %q", tc.folder, tc.delim, segs, tc.segs)
+		}
+		if tc.delim != "" && strings.Join(segs, tc.delim) != tc.folder {
+			t.Errorf("%q on %q rejoins as %q", tc.folder, tc.delim, strings.Join(segs, tc.delim))
+		}
+	}
+
+	// entries written before the delimiter record split at "/" unescaped
+	old := &tar.Header{Name: "Work/A%2FB/1.eml"}
+	if got, want := entryFolder(old), []string{"Work", "A%2FB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("legacy entry reads back as %q, want %q", got, want)
+	}
+}
+
+// TestWipeLeavesForeignDeleted checks that with UIDPLUS only the chosen
+// UIDs are expunged, not other mail already flagged \Deleted.
+func TestWipeLeavesForeignDeleted(t *testing.T) {
+	setFlags(t, "quiet", "true")
+	s := newFakeServer(t, "UIDPLUS")
+	when := time.Now()
+	s.add("INBOX", 1, []string{imap.DeletedFlag}, when, rfc822("a@example.com", "old", "x"))
+	s.add("INBOX", 2, nil, when, rfc822("b@example.com", "spam", "x"))
+	s.add("INBOX", 3, nil, when, rfc822("c@example.com", "keep", "x"))
+	cli := s.login(t)
+
+	wipe(cli, map[string][]uint32{"INBOX": {2}})
+	if got, want := s.uids("INBOX"), []uint32{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("INBOX holds %v, want %v", got, want)
+	}
+	if s.count("EXPUNGE") != 0 || s.count("UID EXPUNGE") == 0 {
+		t.Errorf("commands %v: want UID EXPUNGE only", s.cmds)
+	}
+}